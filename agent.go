@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"time"
 )
 
@@ -28,6 +30,14 @@ func main() {
 
 	config = LoadConfig()
 
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args(), os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	fmt.Printf("Starting agent (version: %s) with the following configuration:\n", Version)
 	printConfig(config)
 
@@ -38,53 +48,88 @@ func main() {
 	defer logWriter.Close()
 	log.SetOutput(logWriter)
 
-	collectTicker := time.NewTicker(time.Duration(config.CollectIntervalInSeconds) * time.Second)
-	sendTicker := time.NewTicker(time.Duration(config.SendIntervalInSeconds) * time.Second)
-	defer collectTicker.Stop()
-	defer sendTicker.Stop()
-
-	for {
-		select {
-		case <-collectTicker.C:
-			metrics, errors := collectMetrics()
-			if len(errors) > 0 {
-				log.Println("Errors encountered while collecting metrics:")
-				for _, err := range errors {
-					log.Println(err)
-				}
-			}
+	if !validCompression(config.Compression) {
+		panic(fmt.Sprintf("Invalid compression: %q", config.Compression))
+	}
+	metricsHTTPClient, err = newIngestHTTPClient(config)
+	if err != nil {
+		panic(fmt.Sprintf("Error setting up the ingest client: %v", err))
+	}
+	if _, err := signingSecret(config.Signing); err != nil {
+		panic(fmt.Sprintf("Error setting up request signing: %v", err))
+	}
 
-			attributes := getAttributes()
+	destinations, err = configuredDestinations(config)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid destinations: %v", err))
+	}
+	if len(destinations) == 0 {
+		destinations = []*Destination{defaultDestination()}
+	}
+	if err := checkStorageKeySource(config.Storage.Encryption); err != nil {
+		panic(fmt.Sprintf("Invalid storage encryption: %v", err))
+	}
+	if err := migrateLegacyMetricsFile(); err != nil {
+		log.Println("Error importing legacy metrics file:", err)
+	}
 
-			payload := Payload{
-				Version:    Version,
-				Attributes: attributes,
-				Metrics:    metrics,
-			}
+	agentMetrics.Set("agent_start_time_seconds", float64(time.Now().Unix()))
+	for _, destination := range destinations {
+		destination.state.setBreaker(breakerClosed)
+	}
+	if config.PrometheusListenAddress != "" {
+		server, err := startPrometheusServer(config.PrometheusListenAddress)
+		if err != nil {
+			panic(fmt.Sprintf("Error starting Prometheus endpoint: %v", err))
+		}
+		defer server.Close()
+	}
 
-			if err := saveMetricsToFile(payload); err != nil {
-				log.Println("Error saving metrics:", err)
-			}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-		case <-sendTicker.C:
-			log.Println("Trying to send metrics to server...")
-			payload, err := loadMetricsFromFile()
-			if err != nil {
-				log.Println("Error loading metrics from file:", err)
-				continue
-			}
+	if err := startChecks(ctx, config); err != nil {
+		panic(fmt.Sprintf("Error starting checks: %v", err))
+	}
 
-			if len(payload.Metrics) == 0 {
-				log.Println("No metrics available to send")
-				continue
-			}
+	if len(config.LogWatches) > 0 {
+		logTailer, err = NewLogTailer(config.LogWatches, logOffsetsPath())
+		if err != nil {
+			panic(fmt.Sprintf("Error setting up log watches: %v", err))
+		}
+	}
 
-			if err := sendMetrics(payload); err != nil {
-				log.Println("Error sending metrics:", err)
-			} else {
-				log.Println("Metrics succesfully sent... cleaning metrics file")
-				_ = clearMetricsFile()
+	collectTicker := time.NewTicker(time.Duration(config.CollectIntervalInSeconds) * time.Second)
+	sendInterval := time.Duration(config.SendIntervalInSeconds) * time.Second
+	defer collectTicker.Stop()
+	for _, destination := range destinations {
+		go destination.runSender(ctx, sendInterval)
+	}
+
+	for range collectTicker.C {
+		metrics, errors := collectMetrics()
+		metrics = append(metrics, checkResults.Drain()...)
+		latestMetrics.Store(metrics)
+		agentMetrics.Add("agent_collections_total", 1)
+		agentMetrics.Add("agent_collect_errors_total", float64(len(errors)))
+		agentMetrics.Set("agent_last_collect_timestamp_seconds", float64(time.Now().Unix()))
+		if len(errors) > 0 {
+			log.Println("Errors encountered while collecting metrics:")
+			for _, err := range errors {
+				log.Println(err)
 			}
 		}
+
+		attributes := getAttributes()
+
+		payload := Payload{
+			Version:    Version,
+			Attributes: attributes,
+			Metrics:    metrics,
+		}
+
+		if err := saveMetricsToFile(payload); err != nil {
+			log.Println("Error saving metrics:", err)
+		}
 	}
 }
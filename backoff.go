@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultBackoffMaxInterval = 15 * time.Minute
+
+// initialSendOffset delays the first send by a random part of the send interval, so
+// agents started together do not send in lockstep.
+func initialSendOffset(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(interval)))
+}
+
+// nextSendDelay returns when to send again after an attempt that returned err: the send
+// interval after a success, a long pause when the credentials were rejected, the Retry-After
+// delay when the server asked for one, and an exponential backoff with full jitter otherwise.
+// Repeated failures open the circuit breaker, so the next attempt only probes the server.
+func (s *SenderState) nextSendDelay(interval time.Duration, cfg BackoffConfig, breaker CircuitBreaker, err error) time.Duration {
+	switch classifySendError(err) {
+	case sendOK:
+		s.failures = 0
+		if s.breaker != breakerClosed {
+			log.Println("Ingest endpoint recovered; circuit breaker closed")
+			s.setBreaker(breakerClosed)
+		}
+		return interval
+	case sendUnauthorized:
+		pause := breaker.AuthPause
+		if pause <= 0 {
+			pause = defaultAuthPause
+		}
+		s.failures++
+		s.setBreaker(breakerOpen)
+		agentMetrics.Add("agent_auth_failures_total", 1)
+		log.Printf("ERROR: ingest endpoint rejected the auth token (%v); check auth_token, sending is paused for %s", err, pause)
+		return pause
+	case sendMisconfigured:
+		log.Printf("ERROR: ingest endpoint answered %v; check the host, path and proxy settings", err)
+	}
+	s.failures++
+
+	threshold := breaker.FailureThreshold
+	if threshold <= 0 {
+		threshold = defaultBreakerFailureThreshold
+	}
+	if s.failures >= threshold && s.breaker != breakerOpen {
+		log.Printf("Send failed %d times in a row; circuit breaker open", s.failures)
+		s.setBreaker(breakerOpen)
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		log.Printf("Server asked to retry after %s", statusErr.RetryAfter)
+		return statusErr.RetryAfter
+	}
+
+	delay := time.Duration(rand.Int63n(int64(backoffCeiling(interval, cfg, s.failures)) + 1))
+	log.Printf("Send failed %d times in a row; retrying in %s", s.failures, delay.Round(time.Second))
+	return delay
+}
+
+// backoffCeiling doubles the initial interval with each consecutive failure up to the maximum.
+func backoffCeiling(interval time.Duration, cfg BackoffConfig, failures int) time.Duration {
+	initial := cfg.InitialInterval
+	if initial <= 0 {
+		initial = interval
+	}
+	maximum := cfg.MaxInterval
+	if maximum <= 0 {
+		maximum = defaultBackoffMaxInterval
+	}
+
+	ceiling := initial
+	for i := 1; i < failures && ceiling < maximum; i++ {
+		ceiling *= 2
+	}
+	if ceiling > maximum || ceiling <= 0 {
+		ceiling = maximum
+	}
+	return ceiling
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffCeiling(t *testing.T) {
+	t.Parallel()
+
+	cfg := BackoffConfig{MaxInterval: 5 * time.Minute}
+	assert.Equal(t, time.Minute, backoffCeiling(time.Minute, cfg, 1))
+	assert.Equal(t, 2*time.Minute, backoffCeiling(time.Minute, cfg, 2))
+	assert.Equal(t, 4*time.Minute, backoffCeiling(time.Minute, cfg, 3))
+	assert.Equal(t, 5*time.Minute, backoffCeiling(time.Minute, cfg, 4))
+	assert.Equal(t, 5*time.Minute, backoffCeiling(time.Minute, cfg, 500))
+	assert.Equal(t, 20*time.Second, backoffCeiling(time.Minute, BackoffConfig{InitialInterval: 10 * time.Second}, 2))
+	assert.Equal(t, defaultBackoffMaxInterval, backoffCeiling(time.Minute, BackoffConfig{}, 100))
+}
+
+func TestNextSendDelay(t *testing.T) {
+	t.Parallel()
+
+	state := &SenderState{}
+	cfg := BackoffConfig{MaxInterval: 4 * time.Minute}
+	failure := errors.New("connection refused")
+
+	for i := 1; i <= 5; i++ {
+		delay := state.nextSendDelay(time.Minute, cfg, CircuitBreaker{}, failure)
+		assert.GreaterOrEqual(t, delay, time.Duration(0))
+		assert.LessOrEqual(t, delay, backoffCeiling(time.Minute, cfg, i), "full jitter stays below the ceiling")
+	}
+	assert.Equal(t, 5, state.failures)
+
+	retryAfter := fmt.Errorf("wrapped: %w", &StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: 90 * time.Second})
+	assert.Equal(t, 90*time.Second, state.nextSendDelay(time.Minute, cfg, CircuitBreaker{}, retryAfter))
+
+	assert.Equal(t, time.Minute, state.nextSendDelay(time.Minute, cfg, CircuitBreaker{}, nil))
+	assert.Zero(t, state.failures)
+}
+
+func TestInitialSendOffset(t *testing.T) {
+	t.Parallel()
+
+	for i := 0; i < 100; i++ {
+		offset := initialSendOffset(time.Minute)
+		assert.GreaterOrEqual(t, offset, time.Duration(0))
+		assert.Less(t, offset, time.Minute)
+	}
+	assert.Zero(t, initialSendOffset(0))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, 120*time.Second, parseRetryAfter("120", now))
+	assert.Equal(t, 30*time.Second, parseRetryAfter("Thu, 01 Jan 2026 12:00:30 GMT", now))
+	assert.Zero(t, parseRetryAfter("Thu, 01 Jan 2026 11:00:00 GMT", now))
+	assert.Zero(t, parseRetryAfter("-5", now))
+	assert.Zero(t, parseRetryAfter("soon", now))
+	assert.Zero(t, parseRetryAfter("", now))
+}
+
+func TestSendMetrics_RetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "42")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+
+	origConfig := config
+	origClient := metricsHTTPClient
+	config = Config{Schema: "http", Host: strings.TrimPrefix(server.URL, "http://"), AuthToken: "token"}
+	metricsHTTPClient = server.Client()
+	t.Cleanup(func() {
+		config = origConfig
+		metricsHTTPClient = origClient
+	})
+
+	err := defaultDestination().sendMetrics(testPayload("cpu_used"))
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusServiceUnavailable, statusErr.StatusCode)
+	assert.Equal(t, 42*time.Second, statusErr.RetryAfter)
+}
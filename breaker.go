@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Circuit breaker states, as reported by the agent_circuit_breaker_state self-metric.
+const (
+	breakerClosed   = 0
+	breakerOpen     = 1
+	breakerHalfOpen = 2
+
+	defaultBreakerFailureThreshold = 5
+	defaultAuthPause               = 15 * time.Minute
+
+	// Single metrics rejected in a row after which the server is assumed to reject everything,
+	// so the remaining metrics are kept instead of being quarantined one request at a time.
+	maxConsecutiveRejections = 3
+)
+
+// Classes of send outcomes.
+const (
+	sendOK            = iota
+	sendTransient     // 5xx, 408, 429, timeouts, DNS and connection failures: back off and retry
+	sendUnauthorized  // 401 and 403: the credentials are wrong, pause
+	sendRejected      // Other 4xx: the payload is invalid and will never be accepted
+	sendMisconfigured // 404, 405 and 407: the path or the proxy is wrong, back off and keep the queue
+)
+
+func classifySendError(err error) int {
+	if err == nil {
+		return sendOK
+	}
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return sendTransient
+	}
+	switch code := statusErr.StatusCode; {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return sendUnauthorized
+	case code == http.StatusRequestTimeout || code == http.StatusTooManyRequests:
+		return sendTransient
+	case code == http.StatusNotFound || code == http.StatusMethodNotAllowed || code == http.StatusProxyAuthRequired:
+		return sendMisconfigured
+	case code >= 400 && code < 500:
+		return sendRejected
+	}
+	return sendTransient
+}
+
+func (s *SenderState) setBreaker(state int) {
+	s.breaker = state
+	agentMetrics.SetLabeled("agent_circuit_breaker_state", s.labels, float64(state))
+}
+
+// quarantineRejected moves a chunk the server will never accept to the rejected queue,
+// so it no longer blocks the metrics queue.
+func (d *Destination) quarantineRejected(chunk Payload, reason error) error {
+	options, err := d.storageOptions()
+	if err != nil {
+		return err
+	}
+	queue, err := openQueue(d.rejectedQueueDir(), options)
+	if err != nil {
+		return fmt.Errorf("error opening rejected queue: %w", err)
+	}
+	defer queue.Close()
+
+	if _, err := queue.Append(chunk); err != nil {
+		return fmt.Errorf("error quarantining rejected metrics: %w", err)
+	}
+	if _, _, err := queue.Evict(retentionConfig(), time.Now()); err != nil {
+		return fmt.Errorf("error dropping old rejected metrics: %w", err)
+	}
+	agentMetrics.Add("agent_rejected_metrics_total", float64(len(chunk.Metrics)))
+	log.Printf("ERROR: server rejected %d metrics (%v); moved to %s", len(chunk.Metrics), reason, queue.dir)
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifySendError(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, sendOK, classifySendError(nil))
+	assert.Equal(t, sendTransient, classifySendError(errors.New("dial tcp: lookup ingest: no such host")))
+	assert.Equal(t, sendTransient, classifySendError(&StatusError{StatusCode: http.StatusBadGateway}))
+	assert.Equal(t, sendTransient, classifySendError(&StatusError{StatusCode: http.StatusTooManyRequests}))
+	assert.Equal(t, sendTransient, classifySendError(&StatusError{StatusCode: http.StatusRequestTimeout}))
+	assert.Equal(t, sendUnauthorized, classifySendError(fmt.Errorf("wrapped: %w", &StatusError{StatusCode: http.StatusUnauthorized})))
+	assert.Equal(t, sendUnauthorized, classifySendError(&StatusError{StatusCode: http.StatusForbidden}))
+	assert.Equal(t, sendRejected, classifySendError(&StatusError{StatusCode: http.StatusBadRequest}))
+	assert.Equal(t, sendRejected, classifySendError(&StatusError{StatusCode: http.StatusUnprocessableEntity}))
+	assert.Equal(t, sendMisconfigured, classifySendError(&StatusError{StatusCode: http.StatusNotFound}))
+	assert.Equal(t, sendMisconfigured, classifySendError(&StatusError{StatusCode: http.StatusMethodNotAllowed}))
+	assert.Equal(t, sendMisconfigured, classifySendError(&StatusError{StatusCode: http.StatusProxyAuthRequired}))
+}
+
+// saveBacklog queues records of metricsPerRecord metrics each.
+func saveBacklog(t *testing.T, records, metricsPerRecord int) {
+	t.Helper()
+	for i := 0; i < records; i++ {
+		payload := Payload{Version: "test"}
+		for j := 0; j < metricsPerRecord; j++ {
+			payload.Metrics = append(payload.Metrics, Metric{Metric: fmt.Sprintf("m%d_%d", i, j), Value: 1, Timestamp: "2026-01-01T00:00:00Z"})
+		}
+		require.NoError(t, saveMetricsToFile(payload))
+	}
+}
+
+func TestSendQueuedMetrics_NotFoundKeepsBacklog(t *testing.T) {
+	requests := 0
+	setupBreakerServer(t, func(Payload) int {
+		requests++
+		return http.StatusNotFound
+	})
+	saveBacklog(t, 20, 10)
+
+	err := defaultDestination().sendQueuedMetrics()
+	require.Error(t, err)
+	assert.Equal(t, 1, requests, "a wrong path is not bisected")
+	assert.Equal(t, sendMisconfigured, classifySendError(err))
+	senderState.nextSendDelay(time.Minute, config.Backoff, config.CircuitBreaker, err)
+	assert.Equal(t, 1, senderState.failures, "the failure backs off")
+
+	pending, err := pendingRecords(defaultDestination(), false)
+	require.NoError(t, err)
+	assert.Len(t, pending, 20)
+	rejected, err := pendingRecords(defaultDestination(), true)
+	require.NoError(t, err)
+	assert.Empty(t, rejected)
+}
+
+func TestSendQueuedMetrics_StopsIsolatingWhenEverythingIsRejected(t *testing.T) {
+	requests := 0
+	setupBreakerServer(t, func(Payload) int {
+		requests++
+		return http.StatusBadRequest
+	})
+	saveBacklog(t, 20, 10)
+
+	err := defaultDestination().sendQueuedMetrics()
+	require.Error(t, err)
+	assert.Less(t, requests, 30, "single metrics are not sent one request at a time")
+
+	rejected, err := pendingRecords(defaultDestination(), true)
+	require.NoError(t, err)
+	assert.Len(t, rejected, maxConsecutiveRejections-1)
+	pending, err := pendingRecords(defaultDestination(), false)
+	require.NoError(t, err)
+	assert.Len(t, pending, 20, "the backlog is kept")
+}
+
+func setupBreakerServer(t *testing.T, handler func(payload Payload) int) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload Payload
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		w.WriteHeader(handler(payload))
+	}))
+	t.Cleanup(server.Close)
+
+	origConfig := config
+	origClient := metricsHTTPClient
+	origState := senderState
+	config = Config{
+		MetricsPath:    filepath.Join(t.TempDir(), "metrics.json"),
+		Schema:         "http",
+		Host:           strings.TrimPrefix(server.URL, "http://"),
+		AuthToken:      "token",
+		CircuitBreaker: CircuitBreaker{FailureThreshold: 2, AuthPause: time.Hour},
+	}
+	metricsHTTPClient = server.Client()
+	senderState = &SenderState{}
+	t.Cleanup(func() {
+		config = origConfig
+		metricsHTTPClient = origClient
+		senderState = origState
+	})
+}
+
+func metricNames(metrics []Metric) []string {
+	var names []string
+	for _, metric := range metrics {
+		names = append(names, metric.Metric)
+	}
+	return names
+}
+
+func TestSendQueuedMetrics_QuarantinesRejectedMetrics(t *testing.T) {
+	var accepted []string
+	setupBreakerServer(t, func(payload Payload) int {
+		for _, metric := range payload.Metrics {
+			if metric.Metric == "bad" {
+				return http.StatusUnprocessableEntity
+			}
+		}
+		accepted = append(accepted, metricNames(payload.Metrics)...)
+		return http.StatusCreated
+	})
+
+	for _, name := range []string{"a", "b", "bad", "c", "d"} {
+		require.NoError(t, saveMetricsToFile(testPayload(name)))
+	}
+	require.NoError(t, defaultDestination().sendQueuedMetrics())
+	assert.Equal(t, []string{"a", "b", "c", "d"}, accepted)
+
+	pending, err := pendingRecords(defaultDestination(), false)
+	require.NoError(t, err)
+	assert.Empty(t, pending, "the rejected metric no longer blocks the queue")
+
+	rejected, err := pendingRecords(defaultDestination(), true)
+	require.NoError(t, err)
+	require.Len(t, rejected, 1)
+	assert.Equal(t, []string{"bad"}, metricNames(rejected[0].Payload.Metrics))
+}
+
+func TestSendQueuedMetrics_PausesOnRejectedCredentials(t *testing.T) {
+	setupBreakerServer(t, func(Payload) int { return http.StatusUnauthorized })
+
+	require.NoError(t, saveMetricsToFile(testPayload("a")))
+	err := defaultDestination().sendQueuedMetrics()
+	require.Error(t, err)
+
+	assert.Equal(t, time.Hour, senderState.nextSendDelay(time.Minute, config.Backoff, config.CircuitBreaker, err))
+	assert.Equal(t, breakerOpen, senderState.breaker)
+	assert.Equal(t, float64(breakerOpen), agentMetrics.Get("agent_circuit_breaker_state"))
+
+	pending, err := pendingRecords(defaultDestination(), false)
+	require.NoError(t, err)
+	assert.Len(t, pending, 1, "records are kept until the credentials are fixed")
+}
+
+func TestSendQueuedMetrics_CircuitBreakerProbes(t *testing.T) {
+	var requests [][]string
+	failing := true
+	setupBreakerServer(t, func(payload Payload) int {
+		requests = append(requests, metricNames(payload.Metrics))
+		if failing {
+			return http.StatusBadGateway
+		}
+		return http.StatusCreated
+	})
+
+	require.NoError(t, saveMetricsToFile(testPayload("a")))
+	require.NoError(t, saveMetricsToFile(testPayload("b")))
+	require.NoError(t, saveMetricsToFile(testPayload("c")))
+
+	for i := 0; i < 2; i++ {
+		err := defaultDestination().sendQueuedMetrics()
+		require.Error(t, err)
+		senderState.nextSendDelay(time.Minute, config.Backoff, config.CircuitBreaker, err)
+	}
+	assert.Equal(t, breakerOpen, senderState.breaker)
+
+	// The half-open probe fails: only one record was sent and the breaker opens again.
+	requests = nil
+	err := defaultDestination().sendQueuedMetrics()
+	require.Error(t, err)
+	assert.Equal(t, [][]string{{"a"}}, requests)
+	senderState.nextSendDelay(time.Minute, config.Backoff, config.CircuitBreaker, err)
+	assert.Equal(t, breakerOpen, senderState.breaker)
+
+	requests = nil
+	failing = false
+	require.NoError(t, defaultDestination().sendQueuedMetrics())
+	assert.Equal(t, [][]string{{"a"}, {"b", "c"}}, requests, "the backlog follows a successful probe")
+	assert.Equal(t, breakerClosed, senderState.breaker)
+}
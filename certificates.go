@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"time"
+	"uptinio-server-agent/metric_functions"
+)
+
+// Overridable in tests, nil validates chains against the system pool.
+var certificateRoots *x509.CertPool
+
+// collectCertificateMetrics inspects the configured endpoints and files at now and reports
+// the days remaining, chain validity and key size of each certificate.
+func collectCertificateMetrics(checks CertificateChecks, now time.Time) ([]Metric, []error) {
+	var infos []metric_functions.CertificateInfo
+	var errors []error
+
+	for _, endpoint := range checks.Endpoints {
+		info, err := metric_functions.InspectEndpointCertificate(endpoint.Address, endpoint.ServerName, checkTimeout(checks.TimeoutInSeconds), certificateRoots, now)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("error inspecting certificate of %s: %w", endpoint.Address, err))
+			continue
+		}
+		infos = append(infos, info)
+	}
+
+	for _, pattern := range checks.Files {
+		fileInfos, err := metric_functions.InspectCertificateFiles(pattern, certificateRoots, now)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("error inspecting certificate files: %w", err))
+		}
+		infos = append(infos, fileInfos...)
+	}
+
+	timestamp := now.UTC().Format(time.RFC3339)
+	var metrics []Metric
+	for _, info := range infos {
+		labels := map[string]string{
+			"source":  info.Source,
+			"subject": info.Subject,
+			"issuer":  info.Issuer,
+			"serial":  info.Serial,
+		}
+		chainValid := 0.0
+		if info.ChainValid {
+			chainValid = 1
+		}
+		metrics = append(metrics,
+			Metric{Metric: "cert_days_remaining", Value: info.DaysRemaining, Timestamp: timestamp, Labels: labels},
+			Metric{Metric: "cert_chain_valid", Value: chainValid, Timestamp: timestamp, Labels: labels},
+			Metric{Metric: "cert_key_size_bits", Value: float64(info.KeySizeBits), Timestamp: timestamp, Labels: labels},
+		)
+	}
+	return metrics, errors
+}
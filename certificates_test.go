@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectCertificateMetrics(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "server.pem")
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o644))
+
+	origRoots := certificateRoots
+	certificateRoots = x509.NewCertPool()
+	certificateRoots.AddCert(server.Certificate())
+	t.Cleanup(func() { certificateRoots = origRoots })
+
+	metrics, errors := collectCertificateMetrics(CertificateChecks{
+		Endpoints: []CertificateEndpoint{{Address: server.Listener.Addr().String(), ServerName: "example.com"}},
+		Files:     []string{filepath.Join(dir, "*.pem"), filepath.Join(dir, "missing-*.pem")},
+	}, time.Now())
+
+	require.Len(t, errors, 1)
+	assert.Contains(t, errors[0].Error(), "missing-")
+	require.Len(t, metrics, 6)
+
+	bySource := map[string]map[string]Metric{}
+	for _, m := range metrics {
+		if bySource[m.Labels["source"]] == nil {
+			bySource[m.Labels["source"]] = map[string]Metric{}
+		}
+		bySource[m.Labels["source"]][m.Metric] = m
+	}
+
+	endpoint := bySource[server.Listener.Addr().String()]
+	require.NotNil(t, endpoint)
+	assert.Greater(t, endpoint["cert_days_remaining"].Value, 0.0)
+	assert.Equal(t, 1.0, endpoint["cert_chain_valid"].Value)
+	assert.Greater(t, endpoint["cert_key_size_bits"].Value, 0.0)
+	assert.Equal(t, server.Certificate().Issuer.String(), endpoint["cert_days_remaining"].Labels["issuer"])
+
+	file := bySource[certPath]
+	require.NotNil(t, file)
+	assert.Equal(t, endpoint["cert_days_remaining"].Labels["serial"], file["cert_days_remaining"].Labels["serial"])
+}
+
+func TestCollectCertificateMetrics_UnreachableEndpoint(t *testing.T) {
+	t.Parallel()
+
+	metrics, errors := collectCertificateMetrics(CertificateChecks{
+		Endpoints:        []CertificateEndpoint{{Address: "127.0.0.1:1"}},
+		TimeoutInSeconds: 1,
+	}, time.Now())
+
+	assert.Empty(t, metrics)
+	require.Len(t, errors, 1)
+	assert.Contains(t, errors[0].Error(), "127.0.0.1:1")
+}
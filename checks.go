@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+	"uptinio-server-agent/metric_functions"
+)
+
+const defaultCheckTimeout = 10 * time.Second
+
+var checkResults = &CheckResults{}
+
+// Append buffers metrics produced by a check.
+func (c *CheckResults) Append(metrics ...Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics = append(c.metrics, metrics...)
+}
+
+// Drain returns the buffered check metrics and empties the buffer.
+func (c *CheckResults) Drain() []Metric {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	metrics := c.metrics
+	c.metrics = nil
+	return metrics
+}
+
+// startChecks validates the configured checks and probes each one on its own interval
+// until ctx is cancelled.
+func startChecks(ctx context.Context, cfg Config) error {
+	var loops []func()
+	var intervals []int
+
+	for _, check := range cfg.HTTPChecks {
+		probe, err := newHTTPProbe(check)
+		if err != nil {
+			return err
+		}
+		loops = append(loops, func() {
+			result := probe.Run()
+			if result.Err != nil {
+				log.Printf("HTTP check %q failed: %v", check.Name, result.Err)
+			}
+			checkResults.Append(httpCheckMetrics(check, result, time.Now())...)
+		})
+		intervals = append(intervals, check.IntervalInSeconds)
+	}
+
+	for _, check := range cfg.TCPChecks {
+		if check.Name == "" || check.Address == "" {
+			return fmt.Errorf("tcp check requires a name and an address")
+		}
+		probe := metric_functions.TCPProbe{
+			Address: check.Address,
+			Send:    check.Send,
+			Expect:  check.Expect,
+			Timeout: checkTimeout(check.TimeoutInSeconds),
+		}
+		loops = append(loops, func() {
+			result := probe.Run()
+			if result.Err != nil {
+				log.Printf("TCP check %q failed: %v", check.Name, result.Err)
+			}
+			labels := map[string]string{"check": check.Name, "type": "tcp", "target": check.Address}
+			checkResults.Append(checkMetrics(labels, result.Up, result.Latency, time.Now())...)
+		})
+		intervals = append(intervals, check.IntervalInSeconds)
+	}
+
+	for _, check := range cfg.DNSChecks {
+		if check.Name == "" || check.Query == "" {
+			return fmt.Errorf("dns check requires a name and a query")
+		}
+		probe := metric_functions.DNSProbe{
+			Name:       check.Query,
+			RecordType: check.RecordType,
+			Resolver:   check.Resolver,
+			Expected:   check.Expected,
+			Timeout:    checkTimeout(check.TimeoutInSeconds),
+		}
+		loops = append(loops, func() {
+			result := probe.Run()
+			if result.Err != nil {
+				log.Printf("DNS check %q failed: %v", check.Name, result.Err)
+			}
+			labels := map[string]string{"check": check.Name, "type": "dns", "target": check.Query}
+			checkResults.Append(checkMetrics(labels, result.Up, result.Latency, time.Now())...)
+		})
+		intervals = append(intervals, check.IntervalInSeconds)
+	}
+
+	if certs := cfg.CertificateChecks; len(certs.Endpoints) > 0 || len(certs.Files) > 0 {
+		loops = append(loops, func() {
+			metrics, errors := collectCertificateMetrics(certs, time.Now())
+			for _, err := range errors {
+				log.Printf("Certificate check failed: %v", err)
+			}
+			checkResults.Append(metrics...)
+		})
+		intervals = append(intervals, certs.IntervalInSeconds)
+	}
+
+	for i, loop := range loops {
+		go runCheckLoop(ctx, checkInterval(intervals[i]), loop)
+	}
+	return nil
+}
+
+func newHTTPProbe(check HTTPCheck) (metric_functions.HTTPProbe, error) {
+	if check.Name == "" || check.URL == "" {
+		return metric_functions.HTTPProbe{}, fmt.Errorf("http check requires a name and an url")
+	}
+
+	probe := metric_functions.HTTPProbe{
+		Method:         check.Method,
+		URL:            check.URL,
+		Headers:        check.Headers,
+		ExpectedStatus: check.ExpectedStatus,
+		Timeout:        checkTimeout(check.TimeoutInSeconds),
+	}
+	if check.BodyRegex != "" {
+		pattern, err := regexp.Compile(check.BodyRegex)
+		if err != nil {
+			return metric_functions.HTTPProbe{}, fmt.Errorf("invalid body_regex for http check %q: %w", check.Name, err)
+		}
+		probe.BodyPattern = pattern
+	}
+	return probe, nil
+}
+
+// httpCheckMetrics converts a probe result into check metrics labeled by the check.
+func httpCheckMetrics(check HTTPCheck, result metric_functions.HTTPProbeResult, at time.Time) []Metric {
+	labels := map[string]string{"check": check.Name, "type": "http", "target": check.URL}
+	metrics := checkMetrics(labels, result.Up, result.Total, at)
+	timestamp := at.UTC().Format(time.RFC3339)
+
+	timings := []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"check_dns_ms", result.DNS},
+		{"check_connect_ms", result.Connect},
+		{"check_tls_ms", result.TLS},
+		{"check_ttfb_ms", result.TTFB},
+	}
+	metrics = append(metrics, Metric{Metric: "check_status_code", Value: float64(result.StatusCode), Timestamp: timestamp, Labels: labels})
+	for _, timing := range timings {
+		metrics = append(metrics, Metric{Metric: timing.name, Value: durationMillis(timing.duration), Timestamp: timestamp, Labels: labels})
+	}
+	return metrics
+}
+
+// checkMetrics returns the availability and latency metrics shared by all check types.
+func checkMetrics(labels map[string]string, up bool, latency time.Duration, at time.Time) []Metric {
+	timestamp := at.UTC().Format(time.RFC3339)
+	upValue := 0.0
+	if up {
+		upValue = 1
+	}
+	return []Metric{
+		{Metric: "check_up", Value: upValue, Timestamp: timestamp, Labels: labels},
+		{Metric: "check_latency_ms", Value: durationMillis(latency), Timestamp: timestamp, Labels: labels},
+	}
+}
+
+// runCheckLoop runs probe immediately and then every interval until ctx is cancelled.
+func runCheckLoop(ctx context.Context, interval time.Duration, probe func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		probe()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func checkInterval(seconds int) time.Duration {
+	if seconds <= 0 {
+		seconds = config.CollectIntervalInSeconds
+	}
+	if seconds <= 0 {
+		seconds = 60
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func checkTimeout(seconds int) time.Duration {
+	if seconds <= 0 {
+		return defaultCheckTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"uptinio-server-agent/metric_functions"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func metricByName(metrics []Metric, name string) (Metric, bool) {
+	for _, m := range metrics {
+		if m.Metric == name {
+			return m, true
+		}
+	}
+	return Metric{}, false
+}
+
+func TestHTTPCheckMetrics(t *testing.T) {
+	t.Parallel()
+
+	check := HTTPCheck{Name: "api", URL: "https://api.internal/health"}
+	metrics := httpCheckMetrics(check, metric_functions.HTTPProbeResult{
+		Up:         true,
+		StatusCode: 200,
+		Total:      120 * time.Millisecond,
+		DNS:        2 * time.Millisecond,
+		Connect:    3500 * time.Microsecond,
+		TLS:        40 * time.Millisecond,
+		TTFB:       110 * time.Millisecond,
+	}, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	up, ok := metricByName(metrics, "check_up")
+	require.True(t, ok)
+	assert.Equal(t, 1.0, up.Value)
+	assert.Equal(t, "2026-01-01T00:00:00Z", up.Timestamp)
+	assert.Equal(t, map[string]string{"check": "api", "type": "http", "target": "https://api.internal/health"}, up.Labels)
+
+	expected := map[string]float64{
+		"check_status_code": 200,
+		"check_latency_ms":  120,
+		"check_dns_ms":      2,
+		"check_connect_ms":  3.5,
+		"check_tls_ms":      40,
+		"check_ttfb_ms":     110,
+	}
+	for name, value := range expected {
+		m, ok := metricByName(metrics, name)
+		require.True(t, ok, name)
+		assert.Equal(t, value, m.Value, name)
+	}
+}
+
+func TestNewHTTPProbe_Validation(t *testing.T) {
+	t.Parallel()
+
+	_, err := newHTTPProbe(HTTPCheck{Name: "missing-url"})
+	require.Error(t, err)
+
+	_, err = newHTTPProbe(HTTPCheck{Name: "bad-regex", URL: "http://localhost", BodyRegex: "("})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "bad-regex")
+
+	probe, err := newHTTPProbe(HTTPCheck{Name: "ok", URL: "http://localhost", BodyRegex: "^ok$"})
+	require.NoError(t, err)
+	assert.Equal(t, defaultCheckTimeout, probe.Timeout)
+	require.NotNil(t, probe.BodyPattern)
+}
+
+func TestStartChecks_BuffersResults(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("healthy"))
+	}))
+	t.Cleanup(server.Close)
+
+	origResults := checkResults
+	checkResults = &CheckResults{}
+	t.Cleanup(func() { checkResults = origResults })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	require.NoError(t, startChecks(ctx, Config{HTTPChecks: []HTTPCheck{
+		{Name: "local", URL: server.URL, BodyRegex: "healthy", IntervalInSeconds: 60},
+	}}))
+
+	var metrics []Metric
+	require.Eventually(t, func() bool {
+		metrics = append(metrics, checkResults.Drain()...)
+		return len(metrics) > 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	up, ok := metricByName(metrics, "check_up")
+	require.True(t, ok)
+	assert.Equal(t, 1.0, up.Value)
+	assert.Empty(t, checkResults.Drain())
+}
+
+func TestStartChecks_TCPCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("+OK ready\r\n"))
+			conn.Close()
+		}
+	}()
+
+	origResults := checkResults
+	checkResults = &CheckResults{}
+	t.Cleanup(func() { checkResults = origResults })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	address := listener.Addr().String()
+	require.NoError(t, startChecks(ctx, Config{TCPChecks: []TCPCheck{
+		{Name: "queue", Address: address, Expect: "+OK", IntervalInSeconds: 60},
+	}}))
+
+	var metrics []Metric
+	require.Eventually(t, func() bool {
+		metrics = append(metrics, checkResults.Drain()...)
+		return len(metrics) > 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	up, ok := metricByName(metrics, "check_up")
+	require.True(t, ok)
+	assert.Equal(t, 1.0, up.Value)
+	assert.Equal(t, map[string]string{"check": "queue", "type": "tcp", "target": address}, up.Labels)
+	_, ok = metricByName(metrics, "check_latency_ms")
+	assert.True(t, ok)
+}
+
+func TestStartChecks_CertificateCheck(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	t.Cleanup(server.Close)
+
+	origResults := checkResults
+	checkResults = &CheckResults{}
+	t.Cleanup(func() { checkResults = origResults })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	require.NoError(t, startChecks(ctx, Config{CertificateChecks: CertificateChecks{
+		Endpoints:         []CertificateEndpoint{{Address: server.Listener.Addr().String()}},
+		IntervalInSeconds: 60,
+	}}))
+
+	var metrics []Metric
+	require.Eventually(t, func() bool {
+		metrics = append(metrics, checkResults.Drain()...)
+		return len(metrics) > 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	days, ok := metricByName(metrics, "cert_days_remaining")
+	require.True(t, ok)
+	assert.Greater(t, days.Value, 0.0)
+	assert.Equal(t, server.Listener.Addr().String(), days.Labels["source"])
+}
+
+func TestStartChecks_Validation(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	require.Error(t, startChecks(ctx, Config{TCPChecks: []TCPCheck{{Name: "no-address"}}}))
+	require.Error(t, startChecks(ctx, Config{DNSChecks: []DNSCheck{{Name: "no-query"}}}))
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const queueUsage = `usage: uptinio-server-agent -config-path <file> queue [-destination <name>] <command>
+
+commands:
+  stats                        show the pending records, their time span and size
+  dump [-format json|ndjson]   print the pending records
+  export <file>                write the pending records to file as NDJSON
+  import <file>                append the records of a JSON or NDJSON file
+  purge -older-than <duration> drop the pending records older than duration, e.g. 12h
+
+stats, dump, export and purge act on the metrics the server rejected with -rejected.
+Without -destination the commands act on the queue of the top-level host.`
+
+// runCommand runs the subcommand given after the flags, e.g. "queue stats". The commands
+// lock the queue like the agent does, so they can run while the agent is running.
+func runCommand(args []string, stdout io.Writer) error {
+	if len(args) < 1 || args[0] != "queue" {
+		return fmt.Errorf("%s", queueUsage)
+	}
+	flags := flag.NewFlagSet("queue", flag.ContinueOnError)
+	name := flags.String("destination", "", "Name of the destination whose queue to use")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	args = flags.Args()
+	if len(args) < 1 {
+		return fmt.Errorf("%s", queueUsage)
+	}
+	d, err := findDestination(*name)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "stats":
+		return queueStats(d, args[1:], stdout)
+	case "dump":
+		return queueDump(d, args[1:], stdout)
+	case "export":
+		return queueExport(d, args[1:], stdout)
+	case "import":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: queue import <file>")
+		}
+		return queueImport(d, args[1], stdout)
+	case "purge":
+		return queuePurge(d, args[1:], stdout)
+	}
+	return fmt.Errorf("unknown queue command %q\n%s", args[0], queueUsage)
+}
+
+// openCLIQueue opens the metrics queue of the destination, or its queue of rejected metrics.
+func openCLIQueue(d *Destination, rejected bool) (*Queue, error) {
+	if !rejected {
+		return d.openMetricsQueue()
+	}
+	options, err := d.storageOptions()
+	if err != nil {
+		return nil, err
+	}
+	return openQueue(d.rejectedQueueDir(), options)
+}
+
+// inspectCLIQueue opens the queue like openCLIQueue for reading only, without importing the
+// legacy metrics file or repairing damaged data, which is left to the agent.
+func inspectCLIQueue(d *Destination, rejected bool) (*Queue, error) {
+	options, err := d.storageOptions()
+	if err != nil {
+		return nil, err
+	}
+	dir := d.queueDir()
+	if rejected {
+		dir = d.rejectedQueueDir()
+	}
+	return inspectQueue(dir, options)
+}
+
+func pendingRecords(d *Destination, rejected bool) ([]QueueRecord, error) {
+	queue, err := inspectCLIQueue(d, rejected)
+	if err != nil {
+		return nil, err
+	}
+	defer queue.Close()
+	return queue.Pending(0)
+}
+
+func queueStats(d *Destination, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("queue stats", flag.ContinueOnError)
+	rejected := flags.Bool("rejected", false, "Show the metrics the server rejected")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	queue, err := inspectCLIQueue(d, *rejected)
+	if err != nil {
+		return err
+	}
+	defer queue.Close()
+
+	records, err := queue.Pending(0)
+	if err != nil {
+		return err
+	}
+	size, err := queue.Size()
+	if err != nil {
+		return err
+	}
+
+	// Imported records keep their time, so the queue order does not follow it.
+	points := 0
+	var oldest, newest time.Time
+	for i, record := range records {
+		points += len(record.Payload.Metrics)
+		if i == 0 || record.Time.Before(oldest) {
+			oldest = record.Time
+		}
+		if i == 0 || record.Time.After(newest) {
+			newest = record.Time
+		}
+	}
+	fmt.Fprintf(stdout, "directory: %s\n", queue.dir)
+	fmt.Fprintf(stdout, "records: %d\n", len(records))
+	fmt.Fprintf(stdout, "points: %d\n", points)
+	if len(records) > 0 {
+		fmt.Fprintf(stdout, "oldest: %s\n", oldest.Format(time.RFC3339))
+		fmt.Fprintf(stdout, "newest: %s\n", newest.Format(time.RFC3339))
+	}
+	fmt.Fprintf(stdout, "bytes: %d\n", size)
+	fmt.Fprintf(stdout, "segments: %d\n", len(queue.segments))
+	return nil
+}
+
+func queueDump(d *Destination, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("queue dump", flag.ContinueOnError)
+	format := flags.String("format", "json", "Output format, json or ndjson")
+	rejected := flags.Bool("rejected", false, "Dump the metrics the server rejected")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	records, err := pendingRecords(d, *rejected)
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "json":
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if records == nil {
+			records = []QueueRecord{}
+		}
+		return encoder.Encode(records)
+	case "ndjson":
+		return writeNDJSON(stdout, records)
+	}
+	return fmt.Errorf("unknown format %q", *format)
+}
+
+func writeNDJSON(w io.Writer, records []QueueRecord) error {
+	encoder := json.NewEncoder(w)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return fmt.Errorf("error encoding record: %w", err)
+		}
+	}
+	return nil
+}
+
+// queueExport writes the pending records to a file as NDJSON, without acknowledging them.
+func queueExport(d *Destination, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("queue export", flag.ContinueOnError)
+	rejected := flags.Bool("rejected", false, "Export the metrics the server rejected")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: queue export [-rejected] <file>")
+	}
+	path := flags.Arg(0)
+
+	records, err := pendingRecords(d, *rejected)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := writeNDJSON(&buf, records); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf.Bytes(), storageFileMode); err != nil {
+		return fmt.Errorf("error writing export: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("error saving export: %w", err)
+	}
+	fmt.Fprintf(stdout, "Exported %d records to %s\n", len(records), path)
+	return nil
+}
+
+// queueImport appends the records of a dump or export, keeping their IDs and times.
+func queueImport(d *Destination, path string, stdout io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	records, err := readRecords(file)
+	if err != nil {
+		return err
+	}
+
+	queue, err := d.openMetricsQueue()
+	if err != nil {
+		return err
+	}
+	defer queue.Close()
+
+	for _, record := range records {
+		if record.ID == "" {
+			record.ID = newUUID()
+		}
+		if record.Time.IsZero() {
+			record.Time = time.Now().UTC()
+		}
+		if _, err := queue.Import(record); err != nil {
+			return err
+		}
+	}
+	updateQueueMetrics(queue, d.state.labels)
+	fmt.Fprintf(stdout, "Imported %d records from %s\n", len(records), path)
+	return nil
+}
+
+// readRecords decodes a JSON array of records or one record per line.
+func readRecords(r io.Reader) ([]QueueRecord, error) {
+	reader := bufio.NewReader(r)
+	decoder := json.NewDecoder(reader)
+
+	var records []QueueRecord
+	first, err := peekNonSpace(reader)
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading records: %w", err)
+	}
+	if first == '[' {
+		if err := decoder.Decode(&records); err != nil {
+			return nil, fmt.Errorf("error decoding records: %w", err)
+		}
+		return records, nil
+	}
+
+	for {
+		var record QueueRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error decoding record %d: %w", len(records)+1, err)
+		}
+		records = append(records, record)
+	}
+}
+
+func peekNonSpace(reader *bufio.Reader) (byte, error) {
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return b, reader.UnreadByte()
+		}
+	}
+}
+
+func queuePurge(d *Destination, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("queue purge", flag.ContinueOnError)
+	olderThan := flags.Duration("older-than", 0, "Drop the pending records older than this duration")
+	rejected := flags.Bool("rejected", false, "Purge the metrics the server rejected")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *olderThan <= 0 {
+		return fmt.Errorf("usage: queue purge [-rejected] -older-than <duration>")
+	}
+
+	queue, err := openCLIQueue(d, *rejected)
+	if err != nil {
+		return err
+	}
+	defer queue.Close()
+
+	records, points, err := queue.Purge(*olderThan, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Purged %d records (%d points) older than %s\n", records, points, *olderThan)
+	return nil
+}
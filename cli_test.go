@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupCLIQueue(t *testing.T, names ...string) {
+	t.Helper()
+	origConfig := config
+	config = Config{MetricsPath: filepath.Join(t.TempDir(), "metrics.json")}
+	t.Cleanup(func() { config = origConfig })
+
+	for _, name := range names {
+		require.NoError(t, saveMetricsToFile(testPayload(name)))
+	}
+}
+
+func runQueueCommand(t *testing.T, args ...string) string {
+	t.Helper()
+	var out bytes.Buffer
+	require.NoError(t, runCommand(append([]string{"queue"}, args...), &out))
+	return out.String()
+}
+
+func TestQueueCommand_Stats(t *testing.T) {
+	setupCLIQueue(t, "a", "b")
+
+	out := runQueueCommand(t, "stats")
+	assert.Contains(t, out, "records: 2\n")
+	assert.Contains(t, out, "points: 2\n")
+	assert.Contains(t, out, "oldest: ")
+	assert.Contains(t, out, "segments: 1\n")
+}
+
+func TestQueueCommand_StatsDoesNotChangeTheQueue(t *testing.T) {
+	setupCLIQueue(t, "a")
+	legacy := `{"agent_version":"v0","metrics":[{"metric":"mem_used_b","value":1,"timestamp":"2026-01-01T00:00:00Z"}]}`
+	require.NoError(t, os.WriteFile(config.MetricsPath, []byte(legacy), 0o644))
+	segments := segmentFiles(t, defaultDestination().queueDir())
+	require.Len(t, segments, 1)
+	file, err := os.OpenFile(segments[0], os.O_APPEND|os.O_WRONLY, 0o600)
+	require.NoError(t, err)
+	_, err = file.WriteString(`1234abcd {"seq":2`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	before, err := os.ReadFile(segments[0])
+	require.NoError(t, err)
+
+	assert.Contains(t, runQueueCommand(t, "stats"), "records: 1\n")
+	runQueueCommand(t, "dump")
+
+	_, err = os.Stat(config.MetricsPath)
+	assert.NoError(t, err, "the legacy metrics file is left for the agent")
+	after, err := os.ReadFile(segments[0])
+	require.NoError(t, err)
+	assert.Equal(t, before, after, "the torn tail is left for the agent")
+	assert.Empty(t, quarantinedFiles(t, segments[0]))
+}
+
+func TestQueueCommand_Dump(t *testing.T) {
+	setupCLIQueue(t, "a", "b")
+
+	var records []QueueRecord
+	require.NoError(t, json.Unmarshal([]byte(runQueueCommand(t, "dump")), &records))
+	require.Len(t, records, 2)
+	assert.Equal(t, "b", records[1].Payload.Metrics[0].Metric)
+
+	lines := strings.Split(strings.TrimSpace(runQueueCommand(t, "dump", "-format", "ndjson")), "\n")
+	assert.Len(t, lines, 2)
+
+	var out bytes.Buffer
+	require.Error(t, runCommand([]string{"queue", "dump", "-format", "xml"}, &out))
+}
+
+func TestQueueCommand_ExportImport(t *testing.T) {
+	setupCLIQueue(t, "a", "b")
+	exported, err := pendingRecords(defaultDestination(), false)
+	require.NoError(t, err)
+	exportPath := filepath.Join(t.TempDir(), "backlog.ndjson")
+	runQueueCommand(t, "export", exportPath)
+
+	setupCLIQueue(t, "c")
+	assert.Contains(t, runQueueCommand(t, "import", exportPath), "Imported 2 records")
+
+	records, err := pendingRecords(defaultDestination(), false)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, "c", records[0].Payload.Metrics[0].Metric)
+	assert.Equal(t, exported[0].ID, records[1].ID, "imported records keep their IDs")
+	assert.True(t, exported[1].Time.Equal(records[2].Time))
+	assert.Equal(t, uint64(3), records[2].Seq)
+}
+
+func TestReadRecords_JSONArray(t *testing.T) {
+	t.Parallel()
+
+	records, err := readRecords(strings.NewReader(` [{"seq":1,"payload":{"metrics":[{"metric":"a"}]}}]`))
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+
+	_, err = readRecords(strings.NewReader(`{"seq":1}` + "\n{oops"))
+	require.Error(t, err)
+}
+
+func TestQueueCommand_Purge(t *testing.T) {
+	setupCLIQueue(t, "a", "b")
+
+	assert.Contains(t, runQueueCommand(t, "purge", "-older-than", "1h"), "Purged 0 records")
+	time.Sleep(20 * time.Millisecond)
+	assert.Contains(t, runQueueCommand(t, "purge", "-older-than", "10ms"), "Purged 2 records (2 points)")
+
+	var out bytes.Buffer
+	require.Error(t, runCommand([]string{"queue", "purge"}, &out))
+}
+
+func importAged(t *testing.T, name string, at time.Time) {
+	t.Helper()
+	queue, err := defaultDestination().openMetricsQueue()
+	require.NoError(t, err)
+	defer queue.Close()
+	_, err = queue.Import(QueueRecord{ID: newUUID(), Time: at, Payload: testPayload(name)})
+	require.NoError(t, err)
+}
+
+func TestQueueCommand_PurgeImportedOldRecords(t *testing.T) {
+	setupCLIQueue(t, "a")
+	importAged(t, "old", time.Now().Add(-48*time.Hour))
+	require.NoError(t, saveMetricsToFile(testPayload("b")))
+
+	assert.Contains(t, runQueueCommand(t, "purge", "-older-than", "24h"), "Purged 1 records (1 points)")
+	records, err := pendingRecords(defaultDestination(), false)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "a", records[0].Payload.Metrics[0].Metric)
+	assert.Equal(t, "b", records[1].Payload.Metrics[0].Metric)
+}
+
+func TestQueueCommand_StatsUsesRecordTimes(t *testing.T) {
+	setupCLIQueue(t, "a")
+	oldest := time.Date(2025, 3, 1, 8, 0, 0, 0, time.UTC)
+	importAged(t, "old", oldest.Add(time.Hour))
+	importAged(t, "oldest", oldest)
+	records, err := pendingRecords(defaultDestination(), false)
+	require.NoError(t, err)
+	newest := records[0].Time
+
+	out := runQueueCommand(t, "stats")
+	assert.Contains(t, out, "oldest: 2025-03-01T08:00:00Z\n")
+	assert.Contains(t, out, "newest: "+newest.Format(time.RFC3339)+"\n")
+}
+
+func TestQueue_LocksAgainstOtherProcesses(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openQueue(dir, StorageConfig{})
+	require.NoError(t, err)
+
+	// A separate open file stands in for another process.
+	other, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer other.Close()
+
+	locked := make(chan error, 1)
+	go func() { locked <- lockFile(other) }()
+	select {
+	case <-locked:
+		t.Fatal("lock acquired while the queue is open")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	q.Close()
+	select {
+	case err := <-locked:
+		require.NoError(t, err)
+		require.NoError(t, unlockFile(other))
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock not acquired after the queue was closed")
+	}
+}
+
+func TestRunCommand_Usage(t *testing.T) {
+	t.Parallel()
+
+	var out bytes.Buffer
+	err := runCommand([]string{"queue", "shuffle"}, &out)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "usage:")
+}
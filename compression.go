@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// validCompression reports whether the compression is empty, none, gzip or zstd.
+func validCompression(compression string) bool {
+	switch compression {
+	case "", compressionNone, compressionGzip, compressionZstd:
+		return true
+	}
+	return false
+}
+
+// compressData compresses data with gzip or zstd, returning it unchanged for no compression.
+func compressData(data []byte, compression string) ([]byte, error) {
+	switch compression {
+	case "", compressionNone:
+		return data, nil
+	case compressionGzip:
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(data); err != nil {
+			return nil, fmt.Errorf("error compressing data: %w", err)
+		}
+		if err := writer.Close(); err != nil {
+			return nil, fmt.Errorf("error compressing data: %w", err)
+		}
+		return buf.Bytes(), nil
+	case compressionZstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("unsupported compression: %q", compression)
+}
+
+// decompressData reverses compressData.
+func decompressData(data []byte, compression string) ([]byte, error) {
+	switch compression {
+	case "", compressionNone:
+		return data, nil
+	case compressionGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing data: %w", err)
+		}
+		defer reader.Close()
+		decoded, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing data: %w", err)
+		}
+		return decoded, nil
+	case compressionZstd:
+		decoded, err := zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing data: %w", err)
+		}
+		return decoded, nil
+	}
+	return nil, fmt.Errorf("unsupported compression: %q", compression)
+}
@@ -37,9 +37,10 @@ func LoadConfig() Config {
 	return config
 }
 
-// printConfig prints the configuration in a readable YAML format
+// printConfig prints the configuration in a readable YAML format, with secrets redacted
 func printConfig(config Config) error {
 	// Marshal the configuration into YAML format
+	config = redactConfig(config)
 	yamlData, err := yaml.Marshal(&config)
 	if err != nil {
 		return fmt.Errorf("error marshalling configuration: %w", err)
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Quarantined files keep their name with this suffix and the UTC time they were moved aside.
+const corruptSuffix = ".corrupt-"
+
+// quarantinePath returns where a corrupt copy of path is kept.
+func quarantinePath(path string, now time.Time) string {
+	return path + corruptSuffix + now.UTC().Format("20060102T150405.000000000Z")
+}
+
+// reportCorruption logs a corruption event and counts it in the self-metrics.
+func reportCorruption(format string, args ...interface{}) {
+	agentMetrics.Add("agent_corruption_events_total", 1)
+	log.Printf("CORRUPTION: "+format, args...)
+}
+
+// quarantineFile moves a corrupt file aside and returns its new path.
+func quarantineFile(path string) (string, error) {
+	quarantined := quarantinePath(path, time.Now())
+	if err := os.Rename(path, quarantined); err != nil {
+		return "", fmt.Errorf("error quarantining %s: %w", path, err)
+	}
+	return quarantined, nil
+}
+
+// recordLines splits segment data into complete lines and the partial line after the last newline.
+func recordLines(data []byte) ([][]byte, []byte) {
+	var lines [][]byte
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			break
+		}
+		lines = append(lines, data[:end+1])
+		data = data[end+1:]
+	}
+	return lines, data
+}
+
+// repairSegment keeps a quarantined copy of a segment containing damaged or undecodable
+// records and rewrites the segment with the records it can decode only.
+func (q *Queue) repairSegment(first uint64, data []byte) error {
+	path := q.segmentPath(first)
+	quarantined := quarantinePath(path, time.Now())
+	if err := os.WriteFile(quarantined, data, storageFileMode); err != nil {
+		return fmt.Errorf("error quarantining segment: %w", err)
+	}
+
+	lines, _ := recordLines(data)
+	var intact []byte
+	dropped := 0
+	for _, line := range lines {
+		if _, err := decodeRecord(line, q.options.key); err != nil {
+			dropped++
+			continue
+		}
+		intact = append(intact, line...)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, intact, storageFileMode); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error writing segment: %w", err)
+	}
+	if q.options.Fsync != fsyncNever {
+		if err := syncFile(tmpPath); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("error replacing segment: %w", err)
+	}
+	reportCorruption("dropped %d damaged or undecodable records from queue segment %s, original kept at %s", dropped, path, quarantined)
+	return nil
+}
+
+// recoverLegacyPayload decodes a metrics file written by older agent versions, returning
+// the version, attributes and metrics read before the first error when it is damaged.
+func recoverLegacyPayload(data []byte) (Payload, error) {
+	var payload Payload
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return payload, fmt.Errorf("error decoding file: not a JSON object")
+	}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return payload, fmt.Errorf("error decoding file: %w", err)
+		}
+		switch token {
+		case "agent_version":
+			err = decoder.Decode(&payload.Version)
+		case "attributes":
+			err = decoder.Decode(&payload.Attributes)
+		case "metrics":
+			if token, err = decoder.Token(); err == nil && token != json.Delim('[') {
+				err = fmt.Errorf("metrics is not an array")
+			}
+			for err == nil && decoder.More() {
+				var metric Metric
+				if err = decoder.Decode(&metric); err == nil {
+					payload.Metrics = append(payload.Metrics, metric)
+				}
+			}
+			if err == nil {
+				_, err = decoder.Token()
+			}
+		default:
+			var skipped json.RawMessage
+			err = decoder.Decode(&skipped)
+		}
+		if err != nil {
+			return payload, fmt.Errorf("error decoding file: %w", err)
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return payload, fmt.Errorf("error decoding file: %w", err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func quarantinedFiles(t *testing.T, pattern string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(pattern + corruptSuffix + "*")
+	require.NoError(t, err)
+	return matches
+}
+
+func TestQueue_RepairsDamagedRecordsBeforeIntactOnes(t *testing.T) {
+	dir := t.TempDir()
+	appendPayloads(t, dir, StorageConfig{}, "a", "b", "c")
+	events := agentMetrics.Get("agent_corruption_events_total")
+
+	segments := segmentFiles(t, dir)
+	require.Len(t, segments, 1)
+	data, err := os.ReadFile(segments[0])
+	require.NoError(t, err)
+	lines, _ := recordLines(data)
+	data[len(lines[0])+20] ^= 0xff // damage "b"
+	require.NoError(t, os.WriteFile(segments[0], data, 0o600))
+
+	// The damaged record is not taken for a torn tail: "c" survives and new records follow it.
+	appendPayloads(t, dir, StorageConfig{}, "d")
+	assert.Equal(t, []string{"a", "c", "d"}, pendingNames(t, dir, StorageConfig{}))
+
+	quarantined := quarantinedFiles(t, segments[0])
+	require.Len(t, quarantined, 1)
+	saved, err := os.ReadFile(quarantined[0])
+	require.NoError(t, err)
+	assert.Equal(t, data, saved, "the original segment is kept")
+	assert.Equal(t, events+1, agentMetrics.Get("agent_corruption_events_total"))
+}
+
+func TestQueue_QuarantinesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	appendPayloads(t, dir, StorageConfig{}, "a")
+	segments := segmentFiles(t, dir)
+	require.Len(t, segments, 1)
+
+	file, err := os.OpenFile(segments[0], os.O_APPEND|os.O_WRONLY, 0o600)
+	require.NoError(t, err)
+	_, err = file.WriteString(`1234abcd {"seq":2`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	assert.Equal(t, []string{"a"}, pendingNames(t, dir, StorageConfig{}))
+	quarantined := quarantinedFiles(t, segments[0])
+	require.Len(t, quarantined, 1)
+	saved, err := os.ReadFile(quarantined[0])
+	require.NoError(t, err)
+	assert.Equal(t, `1234abcd {"seq":2`, string(saved))
+}
+
+func TestQueue_QuarantinesInvalidAckFile(t *testing.T) {
+	dir := t.TempDir()
+	appendPayloads(t, dir, StorageConfig{}, "a", "b")
+	ackPath := filepath.Join(dir, ackFileName)
+	require.NoError(t, os.WriteFile(ackPath, []byte("not a number"), 0o600))
+
+	assert.Equal(t, []string{"a", "b"}, pendingNames(t, dir, StorageConfig{}))
+	assert.Len(t, quarantinedFiles(t, ackPath), 1)
+}
+
+func TestLegacyMetricsFileIsRecoveredAndQuarantined(t *testing.T) {
+	dir := t.TempDir()
+	metricsPath := filepath.Join(dir, "metrics.json")
+
+	origConfig := config
+	config = Config{MetricsPath: metricsPath}
+	t.Cleanup(func() { config = origConfig })
+
+	truncated := `{"agent_version":"v0","attributes":{"motherboard_id":"abc"},"metrics":[` +
+		`{"metric":"mem_used_b","value":1024,"timestamp":"2026-01-01T00:00:00Z"},` +
+		`{"metric":"cpu_used","value":3,"timestamp":"2026-01-01T00:00:00Z"},{"metric":"disk_`
+	require.NoError(t, os.WriteFile(metricsPath, []byte(truncated), 0o644))
+
+	require.NoError(t, migrateLegacyMetricsFile())
+	batch, err := defaultDestination().loadMetricsBatch(0)
+	require.NoError(t, err)
+	require.Len(t, batch.Payload.Metrics, 2)
+	assert.Equal(t, "v0", batch.Payload.Version)
+	assert.Equal(t, "abc", batch.Payload.Attributes["motherboard_id"])
+
+	_, err = os.Stat(metricsPath)
+	assert.True(t, os.IsNotExist(err))
+	quarantined := quarantinedFiles(t, metricsPath)
+	require.Len(t, quarantined, 1)
+	saved, err := os.ReadFile(quarantined[0])
+	require.NoError(t, err)
+	assert.Equal(t, truncated, string(saved))
+}
+
+func TestRecoverLegacyPayload(t *testing.T) {
+	t.Parallel()
+
+	payload, err := recoverLegacyPayload([]byte(`{"metrics":[{"metric":"a","value":1}],"extra":{"x":[1]},"agent_version":"v0"}`))
+	require.NoError(t, err)
+	assert.Equal(t, "v0", payload.Version)
+	require.Len(t, payload.Metrics, 1)
+
+	payload, err = recoverLegacyPayload([]byte(`{"metrics":[{"metric":"a","value":1},{"metric":"b","value":"oops"}]}`))
+	require.Error(t, err)
+	require.Len(t, payload.Metrics, 1)
+
+	_, err = recoverLegacyPayload([]byte("\x00\x00"))
+	require.Error(t, err)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const formatUptinio = "uptinio"
+
+var (
+	// Destinations configured at startup, nil when the top-level host is the only destination.
+	destinations []*Destination
+
+	destinationNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+)
+
+func newDestination(cfg DestinationConfig) *Destination {
+	if cfg.Format == "" {
+		cfg.Format = formatUptinio
+	}
+	if cfg.Path == "" {
+		cfg.Path = defaultPath(cfg.Format)
+	}
+	return &Destination{
+		DestinationConfig: cfg,
+		state:             &SenderState{labels: map[string]string{"destination": cfg.Name}},
+		tokens:            &TokenSource{},
+	}
+}
+
+// defaultDestination returns the destination described by the top-level schema, host and
+// auth token settings. It uses the global sender state and token source.
+func defaultDestination() *Destination {
+	return &Destination{
+		DestinationConfig: DestinationConfig{
+			Schema:           config.Schema,
+			Host:             config.Host,
+			Path:             HOST_PATH,
+			Format:           formatUptinio,
+			AuthToken:        config.AuthToken,
+			AuthTokenFile:    config.AuthTokenFile,
+			AuthTokenEnv:     config.AuthTokenEnv,
+			AuthTokenCommand: config.AuthTokenCommand,
+		},
+		state:  senderState,
+		tokens: authTokens,
+	}
+}
+
+// configuredDestinations validates the destinations list of cfg. It returns nil when the
+// list is empty.
+func configuredDestinations(cfg Config) ([]*Destination, error) {
+	var result []*Destination
+	names := make(map[string]bool)
+	for i, destination := range cfg.Destinations {
+		if !destinationNamePattern.MatchString(destination.Name) {
+			return nil, fmt.Errorf("destination %d: name %q must be lowercase letters, digits, '-' or '_'", i+1, destination.Name)
+		}
+		if names[destination.Name] {
+			return nil, fmt.Errorf("destination %q is configured twice", destination.Name)
+		}
+		names[destination.Name] = true
+		if !validFormat(destination.Format) {
+			return nil, fmt.Errorf("destination %q has an unknown format %q", destination.Name, destination.Format)
+		}
+		switch destination.Format {
+		case formatFile:
+			if destination.SpoolDir == "" {
+				return nil, fmt.Errorf("destination %q requires a spool_dir", destination.Name)
+			}
+		case formatStdout:
+		default:
+			if destination.Host == "" {
+				return nil, fmt.Errorf("destination %q has no host", destination.Name)
+			}
+		}
+		if destination.Schema == "" {
+			destination.Schema = cfg.Schema
+		}
+		if destination.Format == formatInflux && (destination.Org == "" || destination.Bucket == "") {
+			return nil, fmt.Errorf("destination %q requires an org and a bucket", destination.Name)
+		}
+		result = append(result, newDestination(destination))
+	}
+	return result, nil
+}
+
+func validFormat(format string) bool {
+	switch format {
+	case "", formatUptinio, formatOTLP, formatOTLPJSON, formatRemoteWrite, formatInflux, formatGraphite, formatFile, formatStdout:
+		return true
+	}
+	return false
+}
+
+func defaultPath(format string) string {
+	switch format {
+	case formatOTLP, formatOTLPJSON:
+		return otlpMetricsPath
+	case formatRemoteWrite:
+		return remoteWritePath
+	case formatInflux:
+		return influxWritePath
+	}
+	return HOST_PATH
+}
+
+// encodePayload returns the request body for the payload in the destination's format and
+// its content type.
+func (d *Destination) encodePayload(payload Payload) ([]byte, string, error) {
+	var data []byte
+	var err error
+	switch d.Format {
+	case formatOTLP:
+		return otlpRequest(payload).marshalProto(), protobufContentType, nil
+	case formatRemoteWrite:
+		return remoteWriteBody(payload), protobufContentType, nil
+	case formatInflux:
+		return influxBody(payload), influxContentType, nil
+	case formatOTLPJSON:
+		data, err = json.Marshal(otlpRequest(payload))
+	default:
+		data, err = json.Marshal(payload)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("error marshaling payload: %w", err)
+	}
+	return data, "application/json", nil
+}
+
+// deliver sends the payload to the destination's sink: over HTTP unless the format uses
+// its own protocol, or to local files or stdout.
+func (d *Destination) deliver(payload Payload) error {
+	switch d.Format {
+	case formatGraphite:
+		return d.sendGraphite(payload)
+	case formatFile:
+		return d.writeSpool(payload, time.Now())
+	case formatStdout:
+		return writeStdout(payload)
+	}
+	return d.sendMetrics(payload)
+}
+
+// requestURL returns the URL the destination's requests are posted to.
+func (d *Destination) requestURL() (string, error) {
+	fullURL, err := buildURL(d.Schema, d.Host, d.Path)
+	if err != nil || d.Format != formatInflux {
+		return fullURL, err
+	}
+	return fullURL + "?" + influxQuery(d), nil
+}
+
+// authorization returns the Authorization header value for the token. InfluxDB expects
+// the token after the "Token" scheme.
+func (d *Destination) authorization(token string) string {
+	if d.Format == formatInflux && !strings.HasPrefix(token, influxTokenScheme) {
+		return influxTokenScheme + token
+	}
+	return token
+}
+
+// setFormatHeaders sets the headers the destination's protocol requires.
+func (d *Destination) setFormatHeaders(header http.Header) {
+	if d.Format == formatRemoteWrite {
+		header.Set("Content-Encoding", "snappy")
+		header.Set("X-Prometheus-Remote-Write-Version", remoteWriteVersion)
+	}
+}
+
+// delivered reports whether the response status means the request was ingested. The Uptinio
+// API answers 201 Created, other formats any 2xx status.
+func (d *Destination) delivered(statusCode int) bool {
+	if d.Format == formatUptinio {
+		return statusCode == http.StatusCreated
+	}
+	return statusCode >= 200 && statusCode < 300
+}
+
+// activeDestinations returns the destinations receiving the collected metrics.
+func activeDestinations() []*Destination {
+	if len(destinations) > 0 {
+		return destinations
+	}
+	return []*Destination{defaultDestination()}
+}
+
+// findDestination returns the configured destination with the given name, or the top-level
+// destination for an empty name.
+func findDestination(name string) (*Destination, error) {
+	if name == "" {
+		return defaultDestination(), nil
+	}
+	configured, err := configuredDestinations(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, destination := range configured {
+		if destination.Name == name {
+			return destination, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown destination %q", name)
+}
+
+func (d *Destination) String() string {
+	target := d.Host
+	switch d.Format {
+	case formatFile:
+		target = d.SpoolDir
+	case formatStdout:
+		target = formatStdout
+	}
+	if d.Name == "" {
+		return target
+	}
+	return fmt.Sprintf("%s (%s)", d.Name, target)
+}
+
+// queueDir returns the queue directory derived from the metrics path, e.g.
+// /var/tmp/uptinio-agent/metrics.queue for /var/tmp/uptinio-agent/metrics.json, or
+// metrics.<name>.queue for a named destination.
+func (d *Destination) queueDir() string {
+	return d.pathPrefix() + ".queue"
+}
+
+// rejectedQueueDir returns the directory holding the metrics the server rejected,
+// e.g. /var/tmp/uptinio-agent/metrics.rejected next to metrics.queue.
+func (d *Destination) rejectedQueueDir() string {
+	return d.pathPrefix() + ".rejected"
+}
+
+func (d *Destination) pathPrefix() string {
+	prefix := strings.TrimSuffix(config.MetricsPath, filepath.Ext(config.MetricsPath))
+	if d.Name != "" {
+		prefix += "." + d.Name
+	}
+	return prefix
+}
+
+func (d *Destination) authToken() (string, error) {
+	return d.tokens.Token(d.DestinationConfig)
+}
+
+// runSender sends the queue of the destination on its own schedule until ctx is done, so a
+// slow or failing destination does not delay the others.
+func (d *Destination) runSender(ctx context.Context, interval time.Duration) {
+	timer := time.NewTimer(initialSendOffset(interval))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			log.Printf("Trying to send metrics to %s...", d)
+			err := d.sendQueuedMetrics()
+			if err != nil {
+				log.Printf("Error sending metrics to %s: %v", d, err)
+			}
+			timer.Reset(d.state.nextSendDelay(interval, config.Backoff, config.CircuitBreaker, err))
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfiguredDestinations(t *testing.T) {
+	t.Parallel()
+
+	none, err := configuredDestinations(Config{})
+	require.NoError(t, err)
+	assert.Nil(t, none)
+
+	configured, err := configuredDestinations(Config{
+		Schema: "https",
+		Destinations: []DestinationConfig{
+			{Name: "uptinio", Host: "app.uptinio.com"},
+			{Name: "internal", Schema: "http", Host: "collector:8080", Path: "ingest"},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, configured, 2)
+	assert.Equal(t, "https", configured[0].Schema, "the schema defaults to the top-level one")
+	assert.Equal(t, HOST_PATH, configured[0].Path)
+	assert.Equal(t, formatUptinio, configured[0].Format)
+	assert.Equal(t, "ingest", configured[1].Path)
+	assert.NotSame(t, configured[0].state, configured[1].state)
+
+	for _, destinations := range [][]DestinationConfig{
+		{{Host: "a"}},
+		{{Name: "Prod", Host: "a"}},
+		{{Name: "../prod", Host: "a"}},
+		{{Name: "a", Host: "a"}, {Name: "a", Host: "b"}},
+		{{Name: "a"}},
+		{{Name: "a", Host: "a", Format: "xml"}},
+	} {
+		_, err := configuredDestinations(Config{Destinations: destinations})
+		assert.Error(t, err, "%+v", destinations)
+	}
+}
+
+func TestDestinationQueueDirs(t *testing.T) {
+	origConfig := config
+	config = Config{MetricsPath: "/var/tmp/uptinio-agent/metrics.json"}
+	t.Cleanup(func() { config = origConfig })
+
+	assert.Equal(t, "/var/tmp/uptinio-agent/metrics.queue", defaultDestination().queueDir())
+	assert.Equal(t, "/var/tmp/uptinio-agent/metrics.rejected", defaultDestination().rejectedQueueDir())
+	named := newDestination(DestinationConfig{Name: "internal"})
+	assert.Equal(t, "/var/tmp/uptinio-agent/metrics.internal.queue", named.queueDir())
+	assert.Equal(t, "/var/tmp/uptinio-agent/metrics.internal.rejected", named.rejectedQueueDir())
+}
+
+// setupDestinations starts a server per handler and configures a destination for each,
+// named after its position.
+func setupDestinations(t *testing.T, handlers ...http.HandlerFunc) []*Destination {
+	t.Helper()
+	origConfig := config
+	origDestinations := destinations
+	origClient := metricsHTTPClient
+	t.Cleanup(func() {
+		config = origConfig
+		destinations = origDestinations
+		metricsHTTPClient = origClient
+	})
+
+	config = Config{MetricsPath: filepath.Join(t.TempDir(), "metrics.json"), Schema: "http"}
+	for i, handler := range handlers {
+		server := httptest.NewServer(handler)
+		t.Cleanup(server.Close)
+		config.Destinations = append(config.Destinations, DestinationConfig{
+			Name:      string(rune('a' + i)),
+			Host:      strings.TrimPrefix(server.URL, "http://"),
+			Path:      "ingest/" + string(rune('a'+i)),
+			AuthToken: "token-" + string(rune('a'+i)),
+		})
+	}
+	metricsHTTPClient = &http.Client{}
+
+	var err error
+	destinations, err = configuredDestinations(config)
+	require.NoError(t, err)
+	return destinations
+}
+
+func TestDestinations_IndependentQueues(t *testing.T) {
+	var received []string
+	healthy := func(w http.ResponseWriter, r *http.Request) {
+		var payload Payload
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		assert.Equal(t, "/ingest/a", r.URL.Path)
+		assert.Equal(t, "token-a", r.Header.Get("Authorization"))
+		for _, m := range payload.Metrics {
+			received = append(received, m.Metric)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}
+	brokenRequests := 0
+	broken := func(w http.ResponseWriter, r *http.Request) {
+		brokenRequests++
+		assert.Equal(t, "token-b", r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	configured := setupDestinations(t, healthy, broken)
+
+	require.NoError(t, saveMetricsToFile(testPayload("m1")))
+	require.NoError(t, saveMetricsToFile(testPayload("m2")))
+
+	require.Error(t, configured[1].sendQueuedMetrics())
+	require.NoError(t, configured[0].sendQueuedMetrics())
+	assert.Equal(t, []string{"m1", "m2"}, received)
+	assert.Equal(t, 1, brokenRequests)
+	assert.NotNil(t, configured[1].state.retry, "the broken destination keeps its retry")
+	assert.Nil(t, configured[0].state.retry)
+
+	pending := func(d *Destination) int {
+		records, err := pendingRecords(d, false)
+		require.NoError(t, err)
+		return len(records)
+	}
+	assert.Equal(t, 0, pending(configured[0]))
+	assert.Equal(t, 2, pending(configured[1]), "the broken destination loses nothing")
+	assert.DirExists(t, configured[1].queueDir())
+	assert.NoDirExists(t, defaultDestination().queueDir())
+	assert.Equal(t, 2.0, agentMetrics.GetLabeled("agent_queue_records", map[string]string{"destination": "b"}))
+}
+
+func TestQueueCommand_Destination(t *testing.T) {
+	configured := setupDestinations(t, createdHandler, createdHandler)
+	require.NoError(t, configured[1].saveMetrics(testPayload("only-b")))
+
+	var out bytes.Buffer
+	require.NoError(t, runCommand([]string{"queue", "-destination", "b", "stats"}, &out))
+	assert.Contains(t, out.String(), "records: 1\n")
+	assert.Contains(t, out.String(), "metrics.b.queue")
+
+	out.Reset()
+	require.NoError(t, runCommand([]string{"queue", "-destination", "a", "stats"}, &out))
+	assert.Contains(t, out.String(), "records: 0\n")
+
+	assert.Error(t, runCommand([]string{"queue", "-destination", "c", "stats"}, &out))
+}
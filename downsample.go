@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDownsampleTriggerRatio = 0.5
+	compactedRecordMaxMetrics     = 1000
+)
+
+// Last compaction time of each queue directory, compaction runs at most once per smallest window.
+var lastDownsample sync.Map
+
+// downsampleQueue compacts the aged records of the queue into aggregates when the backlog
+// reaches the trigger ratio of one of its retention limits. Records up to keep are left as
+// is, so that a pending retry resends the same metrics.
+func downsampleQueue(queue *Queue, cfg DownsampleConfig, retention RetentionConfig, now time.Time, keep uint64) error {
+	if len(cfg.Tiers) == 0 {
+		return nil
+	}
+	tiers, err := sortedTiers(cfg.Tiers)
+	if err != nil {
+		return err
+	}
+
+	if last, ok := lastDownsample.Load(queue.dir); ok && now.Sub(last.(time.Time)) < tiers[0].Window {
+		return nil
+	}
+	ratio := cfg.TriggerRatio
+	if ratio <= 0 {
+		ratio = defaultDownsampleTriggerRatio
+	}
+	near, err := nearRetention(queue, retention, ratio, now)
+	if err != nil || !near {
+		return err
+	}
+	lastDownsample.Store(queue.dir, now)
+
+	rewritten, err := queue.Rewrite(func(records []QueueRecord) ([]QueueRecord, bool) {
+		kept := 0
+		for kept < len(records) && records[kept].Seq <= keep {
+			kept++
+		}
+		compacted, changed := compactRecords(records[kept:], tiers, now)
+		return append(records[:kept:kept], compacted...), changed
+	})
+	if err != nil {
+		return fmt.Errorf("error downsampling queue: %w", err)
+	}
+	if rewritten > 0 {
+		agentMetrics.Add("agent_downsampled_segments_total", float64(rewritten))
+		log.Printf("Backlog near its retention limits: downsampled %d queue segments", rewritten)
+	}
+	return nil
+}
+
+func sortedTiers(tiers []DownsampleTier) ([]DownsampleTier, error) {
+	sorted := append([]DownsampleTier(nil), tiers...)
+	for _, tier := range sorted {
+		if tier.Window <= 0 {
+			return nil, fmt.Errorf("downsample tier after %s requires a positive window", tier.After)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].After < sorted[j].After })
+	return sorted, nil
+}
+
+// nearRetention reports whether the backlog reached ratio of its size or age limit. The record
+// limit counts collections, which compaction does not reduce, so it does not trigger it.
+func nearRetention(queue *Queue, retention RetentionConfig, ratio float64, now time.Time) (bool, error) {
+	if retention.MaxBytes > 0 {
+		size, err := queue.Size()
+		if err != nil {
+			return false, err
+		}
+		if float64(size) >= ratio*float64(retention.MaxBytes) {
+			return true, nil
+		}
+	}
+	if retention.MaxAge > 0 {
+		oldest, err := queue.Pending(1)
+		if err != nil {
+			return false, err
+		}
+		if len(oldest) > 0 && now.Sub(oldest[0].Time) >= time.Duration(ratio*float64(retention.MaxAge)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// compactRecords aggregates the metrics of the leading records older than the first tier into
+// min/max/avg/count points over the window of the oldest tier each point reached. The compacted
+// records reuse the last sequence numbers of the records they replace, newer records are kept.
+func compactRecords(records []QueueRecord, tiers []DownsampleTier, now time.Time) ([]QueueRecord, bool) {
+	old := 0
+	for old < len(records) && now.Sub(records[old].Time) >= tiers[0].After {
+		old++
+	}
+	if old == 0 {
+		return records, false
+	}
+
+	type bucket struct {
+		metric Metric
+		start  time.Time
+		sum    float64
+	}
+	buckets := make(map[string]*bucket)
+	var keys []string
+	inputs := 0
+	changed := false
+
+	for _, record := range records[:old] {
+		for _, m := range record.Payload.Metrics {
+			inputs++
+			timestamp, err := time.Parse(time.RFC3339, m.Timestamp)
+			if err != nil {
+				timestamp = record.Time
+			}
+
+			window := tierWindow(tiers, now.Sub(timestamp))
+			aggregate := Aggregate{WindowSeconds: int(window / time.Second), Min: m.Value, Max: m.Value, Count: 1}
+			if m.Aggregate != nil {
+				aggregate = *m.Aggregate
+				if aggregate.WindowSeconds > int(window/time.Second) {
+					window = time.Duration(aggregate.WindowSeconds) * time.Second
+				}
+				aggregate.WindowSeconds = int(window / time.Second)
+			} else {
+				changed = true
+			}
+
+			start := timestamp.Truncate(window)
+			key := fmt.Sprintf("%s|%s|%d|%d", m.Metric, labelsKey(m.Labels), start.Unix(), aggregate.WindowSeconds)
+			b, ok := buckets[key]
+			if !ok {
+				b = &bucket{
+					metric: Metric{Metric: m.Metric, Timestamp: start.UTC().Format(time.RFC3339), Labels: m.Labels},
+					start:  start,
+				}
+				b.metric.Aggregate = &Aggregate{WindowSeconds: aggregate.WindowSeconds, Min: math.Inf(1), Max: math.Inf(-1)}
+				buckets[key] = b
+				keys = append(keys, key)
+			}
+			b.sum += m.Value * float64(aggregate.Count)
+			b.metric.Aggregate.Count += aggregate.Count
+			b.metric.Aggregate.Min = math.Min(b.metric.Aggregate.Min, aggregate.Min)
+			b.metric.Aggregate.Max = math.Max(b.metric.Aggregate.Max, aggregate.Max)
+		}
+	}
+	if !changed && len(keys) == inputs {
+		return records, false
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool { return buckets[keys[i]].start.Before(buckets[keys[j]].start) })
+	metrics := make([]Metric, len(keys))
+	for i, key := range keys {
+		b := buckets[key]
+		b.metric.Value = b.sum / float64(b.metric.Aggregate.Count)
+		metrics[i] = b.metric
+	}
+
+	// Spread the aggregates over the last sequence numbers of the replaced records.
+	count := (len(metrics) + compactedRecordMaxMetrics - 1) / compactedRecordMaxMetrics
+	if count == 0 {
+		count = 1
+	}
+	if count > old {
+		count = old
+	}
+	last := records[old-1].Payload
+	compacted := make([]QueueRecord, 0, count+len(records)-old)
+	per := (len(metrics) + count - 1) / count
+	for i := 0; i < count; i++ {
+		source := records[old-count+i]
+		end := min((i+1)*per, len(metrics))
+		start := min(i*per, end)
+		compacted = append(compacted, QueueRecord{
+			ID:      newUUID(),
+			Seq:     source.Seq,
+			Time:    source.Time,
+			Payload: Payload{Version: last.Version, Attributes: last.Attributes, Metrics: metrics[start:end]},
+		})
+	}
+	return append(compacted, records[old:]...), true
+}
+
+// tierWindow returns the window of the oldest tier reached by a point of the given age.
+func tierWindow(tiers []DownsampleTier, age time.Duration) time.Duration {
+	window := tiers[0].Window
+	for _, tier := range tiers {
+		if age >= tier.After {
+			window = tier.Window
+		}
+	}
+	return window
+}
+
+func labelsKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testTiers = []DownsampleTier{{After: time.Hour, Window: 5 * time.Minute}, {After: 6 * time.Hour, Window: time.Hour}}
+
+func minuteRecords(start time.Time, values ...float64) []QueueRecord {
+	records := make([]QueueRecord, len(values))
+	for i, value := range values {
+		at := start.Add(time.Duration(i) * time.Minute)
+		records[i] = QueueRecord{
+			Seq:  uint64(i + 1),
+			Time: at,
+			Payload: Payload{Version: "test", Metrics: []Metric{
+				{Metric: "cpu_used", Value: value, Timestamp: at.Format(time.RFC3339)},
+			}},
+		}
+	}
+	return records
+}
+
+func TestCompactRecords_AggregatesAgedRecords(t *testing.T) {
+	start := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	records := minuteRecords(start, 1, 2, 3, 4, 5, 6, 7)
+	now := start.Add(time.Hour + 4*time.Minute) // the last two records are not old enough
+
+	compacted, changed := compactRecords(records, testTiers, now)
+	require.True(t, changed)
+	require.Len(t, compacted, 3)
+
+	aggregated := compacted[0].Payload.Metrics
+	require.Len(t, aggregated, 1)
+	assert.Equal(t, uint64(5), compacted[0].Seq, "reuses the last replaced sequence number")
+	assert.Equal(t, "2026-01-01T10:00:00Z", aggregated[0].Timestamp)
+	assert.Equal(t, 3.0, aggregated[0].Value)
+	assert.Equal(t, &Aggregate{WindowSeconds: 300, Min: 1, Max: 5, Count: 5}, aggregated[0].Aggregate)
+
+	assert.Equal(t, records[5:], compacted[1:])
+}
+
+func TestCompactRecords_RecompactsIntoCoarserTier(t *testing.T) {
+	start := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	records := minuteRecords(start, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+	compacted, changed := compactRecords(records, testTiers, start.Add(2*time.Hour))
+	require.True(t, changed)
+	require.Len(t, compacted, 1)
+	require.Len(t, compacted[0].Payload.Metrics, 2)
+
+	compacted, changed = compactRecords(compacted, testTiers, start.Add(7*time.Hour))
+	require.True(t, changed)
+	require.Len(t, compacted, 1)
+	require.Len(t, compacted[0].Payload.Metrics, 1)
+	metric := compacted[0].Payload.Metrics[0]
+	assert.Equal(t, 5.5, metric.Value)
+	assert.Equal(t, &Aggregate{WindowSeconds: 3600, Min: 1, Max: 10, Count: 10}, metric.Aggregate)
+
+	_, changed = compactRecords(compacted, testTiers, start.Add(8*time.Hour))
+	assert.False(t, changed, "already compacted records are left alone")
+}
+
+func TestCompactRecords_NothingOldEnough(t *testing.T) {
+	start := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	records := minuteRecords(start, 1, 2, 3)
+	compacted, changed := compactRecords(records, testTiers, start.Add(30*time.Minute))
+	assert.False(t, changed)
+	assert.Equal(t, records, compacted)
+}
+
+func TestDownsampleQueue_OnlyNearRetention(t *testing.T) {
+	lastDownsample.Clear()
+	t.Cleanup(lastDownsample.Clear)
+
+	dir := t.TempDir()
+	q, err := openQueue(dir, StorageConfig{})
+	require.NoError(t, err)
+	defer q.Close()
+	for i := 0; i < 20; i++ {
+		_, err := q.Append(testPayload("cpu_used"))
+		require.NoError(t, err)
+	}
+
+	cfg := DownsampleConfig{Tiers: testTiers}
+	later := time.Now().Add(2 * time.Hour)
+
+	require.NoError(t, downsampleQueue(q, cfg, RetentionConfig{MaxAge: 24 * time.Hour}, later, 0))
+	records, err := q.Pending(0)
+	require.NoError(t, err)
+	assert.Len(t, records, 20, "backlog far from its limits is kept as is")
+
+	require.NoError(t, downsampleQueue(q, cfg, RetentionConfig{MaxAge: 3 * time.Hour}, later, 0))
+	records, err = q.Pending(0)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, uint64(20), records[0].Seq)
+	require.NotNil(t, records[0].Payload.Metrics[0].Aggregate)
+	assert.Equal(t, 20, records[0].Payload.Metrics[0].Aggregate.Count)
+}
+
+func TestDownsampleQueue_EvictCountsCompactedCollections(t *testing.T) {
+	lastDownsample.Clear()
+	t.Cleanup(lastDownsample.Clear)
+
+	dir := t.TempDir()
+	// Small segments so that each compacts into its own record of about ten collections.
+	q, err := openQueue(dir, StorageConfig{SegmentMaxBytes: 2000})
+	require.NoError(t, err)
+	defer q.Close()
+	start := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	for _, record := range minuteRecords(start, make([]float64, 150)...) {
+		_, err := q.Import(record)
+		require.NoError(t, err)
+	}
+
+	retention := RetentionConfig{MaxRecords: 100, MaxAge: 5 * time.Hour}
+	now := start.Add(150*time.Minute + 2*time.Hour)
+	require.NoError(t, downsampleQueue(q, DownsampleConfig{Tiers: testTiers}, retention, now, 0))
+	compacted, err := q.Pending(0)
+	require.NoError(t, err)
+	require.Less(t, len(compacted), 30)
+	require.Greater(t, len(compacted), 5)
+	assert.Equal(t, 150, q.Len(), "compacted records keep counting their collections")
+
+	dropped, _, err := q.Evict(retention, now)
+	require.NoError(t, err)
+	assert.Less(t, dropped, len(compacted)/2, "only the excess collections are evicted")
+	assert.LessOrEqual(t, q.Len(), 100)
+	assert.Greater(t, q.Len(), 80)
+	records, err := q.Pending(0)
+	require.NoError(t, err)
+	assert.Equal(t, compacted[dropped:], records)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	encryptionCodec = "aes256gcm"
+
+	// Label binding derived keys to the queue, so the auth token itself is never the key.
+	storageKeyLabel = "uptinio-server-agent queue encryption v1"
+)
+
+// storageKey returns the AES-256 key for the queue, derived from the key file when one is
+// configured and from the auth token otherwise. It returns nil when encryption is disabled.
+func storageKey(encryption EncryptionConfig, authToken string) ([]byte, error) {
+	if !encryption.Enabled {
+		return nil, nil
+	}
+
+	secret := []byte(strings.TrimSpace(authToken))
+	if encryption.KeyFile != "" {
+		data, err := os.ReadFile(encryption.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading encryption key file: %w", err)
+		}
+		secret = bytes.TrimSpace(data)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("storage encryption requires a key file or an auth token")
+	}
+	return deriveKey(secret), nil
+}
+
+// checkStorageKeySource checks that every active destination can derive its queue key when
+// no key file is set: it needs a static auth token, since records written under a rotated
+// token could no longer be decrypted, and sinks without a token have nothing to derive from.
+func checkStorageKeySource(encryption EncryptionConfig) error {
+	if !encryption.Enabled || encryption.KeyFile != "" {
+		return nil
+	}
+	for _, destination := range activeDestinations() {
+		if destination.AuthTokenFile != "" || len(destination.AuthTokenCommand) > 0 {
+			return fmt.Errorf("%s: storage encryption requires a key_file when the auth token is read from auth_token_file or auth_token_command", destination)
+		}
+		token, err := destination.authToken()
+		if err != nil {
+			return fmt.Errorf("%s: %w", destination, err)
+		}
+		if token == "" {
+			return fmt.Errorf("%s: storage encryption requires a key_file or an auth token", destination)
+		}
+	}
+	return nil
+}
+
+// deriveKey derives a 256-bit key from the secret with HMAC-SHA256.
+func deriveKey(secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(storageKeyLabel))
+	return mac.Sum(nil)
+}
+
+// encryptData seals data with AES-GCM, returning the random nonce followed by the ciphertext.
+func encryptData(data, key []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// decryptData opens data sealed by encryptData.
+func decryptData(data, key []byte) ([]byte, error) {
+	if key == nil {
+		return nil, fmt.Errorf("encrypted record but storage encryption is disabled")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted record too short")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting record: %w", err)
+	}
+	return plain, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageKey(t *testing.T) {
+	t.Parallel()
+
+	key, err := storageKey(EncryptionConfig{}, "token")
+	require.NoError(t, err)
+	assert.Nil(t, key, "disabled encryption has no key")
+
+	fromToken, err := storageKey(EncryptionConfig{Enabled: true}, " token\n")
+	require.NoError(t, err)
+	assert.Len(t, fromToken, 32)
+	assert.Equal(t, deriveKey([]byte("token")), fromToken)
+
+	keyFile := filepath.Join(t.TempDir(), "queue.key")
+	require.NoError(t, os.WriteFile(keyFile, []byte("file secret\n"), 0600))
+	fromFile, err := storageKey(EncryptionConfig{Enabled: true, KeyFile: keyFile}, "token")
+	require.NoError(t, err)
+	assert.Equal(t, deriveKey([]byte("file secret")), fromFile)
+
+	_, err = storageKey(EncryptionConfig{Enabled: true}, "")
+	require.Error(t, err)
+	_, err = storageKey(EncryptionConfig{Enabled: true, KeyFile: filepath.Join(t.TempDir(), "missing")}, "token")
+	require.Error(t, err)
+}
+
+func TestCheckStorageKeySource(t *testing.T) {
+	origDestinations := destinations
+	t.Cleanup(func() { destinations = origDestinations })
+	t.Setenv("UPTINIO_TOKEN", "env-token")
+
+	enabled := EncryptionConfig{Enabled: true}
+	withKeyFile := EncryptionConfig{Enabled: true, KeyFile: "/etc/uptinio-agent/queue.key"}
+	check := func(encryption EncryptionConfig, configs ...DestinationConfig) error {
+		destinations = nil
+		for _, cfg := range configs {
+			destinations = append(destinations, newDestination(cfg))
+		}
+		return checkStorageKeySource(encryption)
+	}
+
+	assert.NoError(t, check(enabled, DestinationConfig{Name: "a", AuthToken: "token"}))
+	assert.NoError(t, check(enabled, DestinationConfig{Name: "a", AuthTokenEnv: "UPTINIO_TOKEN"}))
+	assert.NoError(t, check(EncryptionConfig{}, DestinationConfig{Name: "a", AuthTokenFile: "/run/token"}))
+	assert.NoError(t, check(withKeyFile, DestinationConfig{Name: "a", AuthTokenFile: "/run/token"}, DestinationConfig{Name: "b", Format: formatStdout}))
+	assert.Error(t, check(enabled, DestinationConfig{Name: "a", AuthTokenFile: "/run/token"}))
+	assert.Error(t, check(enabled, DestinationConfig{Name: "a", AuthTokenCommand: []string{"vault", "read"}}))
+
+	err := check(enabled, DestinationConfig{Name: "a", AuthToken: "token"}, DestinationConfig{Name: "debug", Format: formatStdout})
+	require.Error(t, err, "a sink without a token has no key source")
+	assert.Contains(t, err.Error(), "debug")
+}
+
+func TestEncodeDecodeRecord_Encrypted(t *testing.T) {
+	t.Parallel()
+
+	key := deriveKey([]byte("secret"))
+	for _, compression := range []string{"", compressionZstd} {
+		line, err := encodeRecord(QueueRecord{Seq: 9, Payload: testPayload("cpu_used")}, compression, key)
+		require.NoError(t, err)
+		assert.NotContains(t, string(line), "cpu_used")
+
+		record, err := decodeRecord(line, key)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(9), record.Seq)
+
+		_, err = decodeRecord(line, deriveKey([]byte("other")))
+		require.Error(t, err)
+		_, err = decodeRecord(line, nil)
+		require.Error(t, err)
+	}
+}
+
+func TestQueue_EncryptedRecordsWithWrongKeyAreQuarantined(t *testing.T) {
+	dir := t.TempDir()
+	oldKey := StorageConfig{key: deriveKey([]byte("old token"))}
+	newKey := StorageConfig{key: deriveKey([]byte("new token"))}
+
+	appendPayloads(t, dir, oldKey, "a", "b")
+	appendPayloads(t, dir, newKey, "c")
+	events := agentMetrics.Get("agent_corruption_events_total")
+
+	// Reopening with another key must not take the undecryptable records for a torn tail.
+	assert.Equal(t, []string{"c"}, pendingNames(t, dir, newKey))
+	assert.Equal(t, events+1, agentMetrics.Get("agent_corruption_events_total"))
+	quarantined := quarantinedFiles(t, filepath.Join(dir, "*"+segmentExtension))
+	require.Len(t, quarantined, 1, "the original segment is kept aside")
+
+	// The undecryptable records are reported once, not on every scan.
+	assert.Equal(t, []string{"c"}, pendingNames(t, dir, newKey))
+	assert.Equal(t, events+1, agentMetrics.Get("agent_corruption_events_total"))
+
+	q, err := openQueue(dir, newKey)
+	require.NoError(t, err)
+	defer q.Close()
+	records, err := q.Pending(0)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, uint64(3), records[0].Seq, "sequence numbers of undecryptable records are not reused")
+}
+
+func TestQueue_RestrictivePermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("POSIX permissions")
+	}
+	dir := filepath.Join(t.TempDir(), "metrics.queue")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	appendPayloads(t, dir, StorageConfig{}, "a")
+
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, storageDirMode, info.Mode().Perm())
+	for _, path := range segmentFiles(t, dir) {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, storageFileMode, info.Mode().Perm())
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// fileInode is not available on Windows, rotation is detected through truncation only.
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	formatGraphite = "graphite"
+
+	defaultGraphitePrefixTemplate = "servers.{hostname}.{metric}"
+)
+
+var (
+	graphitePlaceholder = strings.NewReplacer(".", "_", " ", "_", ";", "_", "=", "_", "~", "_")
+	graphiteTagValue    = strings.NewReplacer(" ", "_", ";", "_", "~", "_")
+)
+
+// graphiteBody encodes the payload in the Graphite plaintext protocol, one "path value
+// timestamp" line per metric. The path comes from the destination's prefix template, where
+// {metric} and {<attribute>} placeholders are replaced by the metric name and the attribute
+// values. Labels are appended as Graphite tags, e.g. servers.web-1.disk_used;mount=/data.
+func graphiteBody(payload Payload, template string) []byte {
+	if template == "" {
+		template = defaultGraphitePrefixTemplate
+	}
+
+	var b strings.Builder
+	for _, m := range payload.Metrics {
+		b.WriteString(graphitePath(template, payload.Attributes, m))
+		names := make([]string, 0, len(m.Labels))
+		for name, value := range m.Labels {
+			if value != "" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&b, ";%s=%s", graphitePlaceholder.Replace(name), graphiteTagValue.Replace(m.Labels[name]))
+		}
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatFloat(m.Value, 'g', -1, 64))
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(metricTime(m).Unix(), 10))
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+// graphitePath expands the template for the metric. Dots and other separators in the
+// values are replaced, so each placeholder stays a single path component. Unknown
+// placeholders expand to "unknown".
+func graphitePath(template string, attributes map[string]interface{}, m Metric) string {
+	var b strings.Builder
+	for {
+		before, rest, found := strings.Cut(template, "{")
+		name, after, closed := strings.Cut(rest, "}")
+		if !found || !closed {
+			b.WriteString(template)
+			return b.String()
+		}
+		b.WriteString(before)
+		value := "unknown"
+		if name == "metric" {
+			value = m.Metric
+		} else if attribute, ok := attributes[name]; ok && fmt.Sprint(attribute) != "" {
+			value = fmt.Sprint(attribute)
+		}
+		b.WriteString(graphitePlaceholder.Replace(value))
+		template = after
+	}
+}
+
+// sendGraphite writes the payload to the destination's Graphite plaintext listener.
+func (d *Destination) sendGraphite(payload Payload) error {
+	conn, err := net.DialTimeout("tcp", d.Host, ingestTimeout)
+	if err != nil {
+		return fmt.Errorf("error connecting to Graphite: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(ingestTimeout)); err != nil {
+		return fmt.Errorf("error setting Graphite deadline: %w", err)
+	}
+	if _, err := conn.Write(graphiteBody(payload, d.PrefixTemplate)); err != nil {
+		return fmt.Errorf("error writing to Graphite: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphiteBody(t *testing.T) {
+	t.Parallel()
+
+	payload := Payload{
+		Attributes: map[string]interface{}{"hostname": "web-1.example.com", "region": "eu"},
+		Metrics: []Metric{
+			{Metric: "cpu", Value: 12.5, Timestamp: "2024-01-01T00:00:00Z"},
+			{Metric: "disk_used", Value: 42, Timestamp: "2024-01-01T00:00:00Z", Labels: map[string]string{"mount": "/data", "device": "sda 1"}},
+		},
+	}
+	assert.Equal(t, "servers.web-1_example_com.cpu 12.5 1704067200\n"+
+		"servers.web-1_example_com.disk_used;device=sda_1;mount=/data 42 1704067200\n", string(graphiteBody(payload, "")))
+	assert.Equal(t, "eu.unknown.cpu 12.5 1704067200\n",
+		string(graphiteBody(Payload{Attributes: payload.Attributes, Metrics: payload.Metrics[:1]}, "{region}.{rack}.{metric}")))
+}
+
+func TestDestination_Graphite(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	origConfig := config
+	config = Config{MetricsPath: filepath.Join(t.TempDir(), "metrics.json")}
+	t.Cleanup(func() { config = origConfig })
+	destination := newDestination(DestinationConfig{
+		Name:           "graphite",
+		Host:           listener.Addr().String(),
+		Format:         formatGraphite,
+		PrefixTemplate: "agents.{metric}",
+	})
+
+	require.NoError(t, destination.saveMetrics(testPayload("cpu")))
+	require.NoError(t, destination.sendQueuedMetrics())
+	assert.Regexp(t, `^agents\.cpu 1 \d+\n$`, <-received)
+
+	records, err := pendingRecords(destination, false)
+	require.NoError(t, err)
+	assert.Empty(t, records)
+
+	listener.Close()
+	require.NoError(t, destination.saveMetrics(testPayload("cpu")))
+	assert.Error(t, destination.sendQueuedMetrics(), "records stay queued while Graphite is down")
+	records, err = pendingRecords(destination, false)
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+)
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("error generating UUID: %v", err))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b)
+}
+
+func formatUUID(b [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// chunkKey returns the idempotency key of the request carrying metrics [start, end) of the
+// batch. It only depends on the records and positions of the first and last metric, so the
+// retry of a failed request gets the same key. The retry range is only kept in memory: after
+// a restart the chunks start from max_payload_metrics again, so their keys may differ.
+func (b MetricsBatch) chunkKey(start, end int) string {
+	r := b.metricRange(start, end)
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d-%s:%d",
+		b.recordKey(r.FirstSeq), r.FirstOffset, b.recordKey(r.LastSeq), r.LastOffset)))
+
+	var key [16]byte
+	copy(key[:], sum[:])
+	key[6] = key[6]&0x0f | 0x80 // version 8, custom
+	key[8] = key[8]&0x3f | 0x80
+	return formatUUID(key)
+}
+
+// recordKey identifies a record by its UUID, or by its sequence number for records
+// written before UUIDs were assigned.
+func (b MetricsBatch) recordKey(seq uint64) string {
+	if id := b.IDs[seq]; id != "" {
+		return id
+	}
+	return fmt.Sprintf("seq-%d", seq)
+}
+
+// recordRefs lists the records with metrics in [start, end).
+func (b MetricsBatch) recordRefs(start, end int) []RecordRef {
+	var refs []RecordRef
+	for i := start; i < end; i++ {
+		if len(refs) == 0 || refs[len(refs)-1].Seq != b.Seqs[i] {
+			refs = append(refs, RecordRef{ID: b.IDs[b.Seqs[i]], Seq: b.Seqs[i]})
+		}
+	}
+	return refs
+}
+
+func (b MetricsBatch) metricRange(start, end int) *MetricRange {
+	return &MetricRange{
+		FirstSeq:    b.Seqs[start],
+		FirstOffset: b.Offsets[start],
+		LastSeq:     b.Seqs[end-1],
+		LastOffset:  b.Offsets[end-1],
+	}
+}
+
+// retryEnd returns the end of the failed request r when the batch resumes at its first
+// metric, so exactly the same metrics are sent again, and 0 otherwise.
+func (b MetricsBatch) retryEnd(start int, r *MetricRange) int {
+	if r == nil || b.Seqs[start] != r.FirstSeq || b.Offsets[start] != r.FirstOffset {
+		return 0
+	}
+	for i := start; i < len(b.Seqs); i++ {
+		if b.Seqs[i] == r.LastSeq && b.Offsets[i] == r.LastOffset {
+			return i + 1
+		}
+	}
+	return 0
+}
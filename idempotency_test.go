@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+func TestNewUUID(t *testing.T) {
+	t.Parallel()
+
+	id := newUUID()
+	assert.Regexp(t, uuidPattern, id)
+	assert.Equal(t, byte('4'), id[14])
+	assert.NotEqual(t, id, newUUID())
+}
+
+func TestChunkKey(t *testing.T) {
+	t.Parallel()
+
+	batch := mergeRecords([]QueueRecord{
+		{ID: "id-1", Seq: 1, Payload: Payload{Metrics: []Metric{{Metric: "a"}, {Metric: "b"}}}},
+		{ID: "id-2", Seq: 2, Payload: Payload{Metrics: []Metric{{Metric: "c"}}}},
+	})
+	key := batch.chunkKey(1, 3)
+	assert.Regexp(t, uuidPattern, key)
+	assert.NotEqual(t, key, batch.chunkKey(0, 3))
+	assert.NotEqual(t, key, batch.chunkKey(1, 2))
+	assert.Equal(t, []RecordRef{{ID: "id-1", Seq: 1}, {ID: "id-2", Seq: 2}}, batch.recordRefs(1, 3))
+
+	// The same metrics loaded in a larger batch get the same key.
+	larger := mergeRecords([]QueueRecord{
+		{ID: "id-1", Seq: 1, Payload: Payload{Metrics: []Metric{{Metric: "a"}, {Metric: "b"}}}},
+		{ID: "id-2", Seq: 2, Payload: Payload{Metrics: []Metric{{Metric: "c"}}}},
+		{ID: "id-3", Seq: 3, Payload: Payload{Metrics: []Metric{{Metric: "d"}}}},
+	})
+	assert.Equal(t, key, larger.chunkKey(1, 3))
+}
+
+func setupIdempotencyServer(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	origConfig := config
+	origClient := metricsHTTPClient
+	origState := senderState
+	config = Config{
+		MetricsPath:       filepath.Join(t.TempDir(), "metrics.json"),
+		Schema:            "http",
+		Host:              strings.TrimPrefix(server.URL, "http://"),
+		AuthToken:         "token",
+		MaxPayloadMetrics: 2,
+	}
+	metricsHTTPClient = server.Client()
+	senderState = &SenderState{}
+	t.Cleanup(func() {
+		config = origConfig
+		metricsHTTPClient = origClient
+		senderState = origState
+	})
+}
+
+func TestSendQueuedMetrics_RetryReusesIdempotencyKey(t *testing.T) {
+	type request struct {
+		key     string
+		payload Payload
+	}
+	var requests []request
+	failing := true
+	setupIdempotencyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var payload Payload
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		requests = append(requests, request{key: r.Header.Get("Idempotency-Key"), payload: payload})
+		if failing {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	require.NoError(t, saveMetricsToFile(testPayload("a")))
+	require.Error(t, defaultDestination().sendQueuedMetrics())
+	require.Len(t, requests, 1)
+	first := requests[0]
+	assert.Regexp(t, uuidPattern, first.key)
+	assert.Equal(t, first.key, first.payload.BatchID)
+	require.Len(t, first.payload.Records, 1)
+	assert.Equal(t, uint64(1), first.payload.Records[0].Seq)
+	assert.Regexp(t, uuidPattern, first.payload.Records[0].ID)
+
+	// A record collected before the retry must not change the retried request.
+	require.NoError(t, saveMetricsToFile(testPayload("b")))
+	failing = false
+	require.NoError(t, defaultDestination().sendQueuedMetrics())
+	require.Len(t, requests, 3)
+	assert.Equal(t, first.key, requests[1].key)
+	assert.Equal(t, first.payload.Metrics, requests[1].payload.Metrics)
+	assert.Equal(t, "b", requests[2].payload.Metrics[0].Metric)
+	assert.NotEqual(t, first.key, requests[2].key)
+}
+
+func TestSendQueuedMetrics_DownsamplingKeepsPendingRetry(t *testing.T) {
+	var requests []Payload
+	failing := true
+	setupIdempotencyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var payload Payload
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		requests = append(requests, payload)
+		if failing {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	config.Retention = RetentionConfig{MaxAge: 4 * time.Hour}
+	config.Downsample = DownsampleConfig{Tiers: testTiers}
+	lastDownsample.Clear()
+	t.Cleanup(lastDownsample.Clear)
+
+	queue, err := defaultDestination().openMetricsQueue()
+	require.NoError(t, err)
+	for _, record := range minuteRecords(time.Now().Add(-3*time.Hour).Truncate(5*time.Minute), 1, 2, 3, 4) {
+		_, err := queue.Import(record)
+		require.NoError(t, err)
+	}
+	queue.Close()
+
+	require.Error(t, defaultDestination().sendQueuedMetrics())
+	require.Len(t, requests, 1)
+	first := requests[0]
+
+	// Saving runs the compaction, which must leave the records of the retry alone.
+	require.NoError(t, saveMetricsToFile(testPayload("b")))
+	failing = false
+	require.NoError(t, defaultDestination().sendQueuedMetrics())
+	require.Len(t, requests, 3)
+	assert.Equal(t, first.BatchID, requests[1].BatchID)
+	assert.Equal(t, first.Metrics, requests[1].Metrics)
+	require.NotNil(t, requests[2].Metrics[0].Aggregate, "the records after the retry are compacted")
+	assert.Equal(t, 2, requests[2].Metrics[0].Aggregate.Count)
+}
+
+func TestSendQueuedMetrics_DuplicateCountsAsAcknowledged(t *testing.T) {
+	setupIdempotencyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+	})
+
+	require.NoError(t, saveMetricsToFile(testPayload("a")))
+	require.NoError(t, defaultDestination().sendQueuedMetrics())
+
+	batch, err := defaultDestination().loadMetricsBatch(0)
+	require.NoError(t, err)
+	assert.Zero(t, batch.LastSeq)
+}
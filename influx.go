@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	formatInflux = "influx"
+
+	influxWritePath     = "api/v2/write"
+	influxContentType   = "text/plain; charset=utf-8"
+	influxTokenScheme   = "Token "
+	influxFieldName     = "value"
+	influxTimePrecision = "ns"
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// influxBody encodes the payload in InfluxDB line protocol, one line per metric with the
+// metric name as measurement, the identifying attributes and the labels as tags and the
+// value in the "value" field, e.g. cpu,hostname=web-1 value=12.5 1704067200000000000.
+func influxBody(payload Payload) []byte {
+	var b strings.Builder
+	for _, m := range payload.Metrics {
+		tags := make(map[string]string, len(seriesAttributes)+len(m.Labels))
+		for _, name := range seriesAttributes {
+			if value, ok := payload.Attributes[name]; ok {
+				tags[name] = fmt.Sprint(value)
+			}
+		}
+		for name, value := range m.Labels {
+			tags[name] = value
+		}
+		names := make([]string, 0, len(tags))
+		for name, value := range tags {
+			if value != "" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		b.WriteString(influxMeasurementEscaper.Replace(m.Metric))
+		for _, name := range names {
+			b.WriteByte(',')
+			b.WriteString(influxTagEscaper.Replace(name))
+			b.WriteByte('=')
+			b.WriteString(influxTagEscaper.Replace(tags[name]))
+		}
+		b.WriteString(" " + influxFieldName + "=")
+		b.WriteString(strconv.FormatFloat(m.Value, 'g', -1, 64))
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(metricTime(m).UnixNano(), 10))
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+// influxQuery returns the query of the write endpoint for the destination's org and bucket.
+func influxQuery(d *Destination) string {
+	return url.Values{
+		"org":       {d.Org},
+		"bucket":    {d.Bucket},
+		"precision": {influxTimePrecision},
+	}.Encode()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInfluxBody(t *testing.T) {
+	t.Parallel()
+
+	body := influxBody(Payload{
+		Attributes: map[string]interface{}{"hostname": "web 1", "motherboard_id": "mb-1", "uptime": 10},
+		Metrics: []Metric{
+			{Metric: "cpu", Value: 12.5, Timestamp: "2024-01-01T00:00:00Z"},
+			{Metric: "disk used", Value: 3e9, Timestamp: "2024-01-01T00:00:00Z", Labels: map[string]string{"mount": "/a,b=c", "empty": ""}},
+		},
+	})
+	assert.Equal(t, "cpu,hostname=web\\ 1,motherboard_id=mb-1 value=12.5 1704067200000000000\n"+
+		"disk\\ used,hostname=web\\ 1,motherboard_id=mb-1,mount=/a\\,b\\=c value=3e+09 1704067200000000000\n", string(body))
+}
+
+func TestDestination_Influx(t *testing.T) {
+	var body, authorization, query, path string
+	configured := setupDestinations(t, func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		body, authorization, query, path = string(data), r.Header.Get("Authorization"), r.URL.RawQuery, r.URL.Path
+		w.WriteHeader(http.StatusNoContent)
+	})
+	config.Destinations[0].Format = formatInflux
+	config.Destinations[0].Path = ""
+	config.Destinations[0].Org = "acme"
+	config.Destinations[0].Bucket = "servers"
+	var err error
+	configured, err = configuredDestinations(config)
+	require.NoError(t, err)
+
+	require.NoError(t, configured[0].saveMetrics(testPayload("cpu")))
+	require.NoError(t, configured[0].sendQueuedMetrics())
+	assert.Equal(t, "/api/v2/write", path)
+	assert.Equal(t, "bucket=servers&org=acme&precision=ns", query)
+	assert.Equal(t, "Token token-a", authorization)
+	assert.Contains(t, body, "cpu value=")
+
+	config.Destinations[0].Bucket = ""
+	_, err = configuredDestinations(config)
+	assert.ErrorContains(t, err, "bucket")
+}
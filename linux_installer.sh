@@ -407,8 +407,13 @@ if [ "$UNINSTALL" = "true" ]; then
   echo "Removing configuration file: $CONFIG_PATH"
   rm -f "$CONFIG_PATH"
 
-  echo "Removing metrics file: $METRICS_PATH"
-  rm -f "$METRICS_PATH"
+  # The queues, rejected metrics, log offsets and quarantined copies sit next to the metrics
+  # file and hold host identifiers.
+  METRICS_DIR=$(dirname "$METRICS_PATH")
+  METRICS_BASE=$(basename "$METRICS_PATH")
+  echo "Removing metrics file, queues and agent state: $METRICS_DIR/${METRICS_BASE%.*}.*"
+  rm -rf "$METRICS_PATH" "$METRICS_DIR/${METRICS_BASE%.*}".* "$METRICS_DIR"/log_offsets.json*
+  rmdir "$METRICS_DIR" 2>/dev/null || true
 
   echo "Removing log file: $LOG_PATH"
   rm -f "$LOG_PATH"
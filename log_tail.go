@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+const logOffsetsFileName = "log_offsets.json"
+
+var logTailer *LogTailer
+
+// logOffsetsPath returns the offsets file stored next to the metrics file.
+func logOffsetsPath() string {
+	return filepath.Join(filepath.Dir(config.MetricsPath), logOffsetsFileName)
+}
+
+// NewLogTailer compiles the patterns of the watches and restores the persisted offsets.
+func NewLogTailer(watches []LogWatch, offsetsPath string) (*LogTailer, error) {
+	tailer := &LogTailer{offsetsPath: offsetsPath, offsets: make(map[string]LogOffset)}
+
+	for _, watch := range watches {
+		if watch.Path == "" || len(watch.Patterns) == 0 {
+			return nil, fmt.Errorf("log watch requires a path and at least one pattern")
+		}
+
+		tailed := tailedLog{path: watch.Path}
+		for name := range watch.Patterns {
+			tailed.names = append(tailed.names, name)
+		}
+		sort.Strings(tailed.names)
+		for _, name := range tailed.names {
+			pattern, err := regexp.Compile(watch.Patterns[name])
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q for %s: %w", name, watch.Path, err)
+			}
+			tailed.patterns = append(tailed.patterns, pattern)
+		}
+		tailer.watches = append(tailer.watches, tailed)
+	}
+
+	data, err := os.ReadFile(offsetsPath)
+	if err == nil {
+		if err := json.Unmarshal(data, &tailer.offsets); err != nil {
+			return nil, fmt.Errorf("error decoding log offsets: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading log offsets: %w", err)
+	}
+	return tailer, nil
+}
+
+// Collect reads the lines appended to each watched file since the last call and
+// returns how many matched each pattern, then persists the new offsets.
+func (t *LogTailer) Collect(now time.Time) ([]Metric, []error) {
+	timestamp := now.UTC().Format(time.RFC3339)
+	var metrics []Metric
+	var errors []error
+
+	for _, watch := range t.watches {
+		counts, err := t.tail(watch)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("error tailing %s: %w", watch.path, err))
+			continue
+		}
+		for i, name := range watch.names {
+			metrics = append(metrics, Metric{
+				Metric:    "log_pattern_matches",
+				Value:     float64(counts[i]),
+				Timestamp: timestamp,
+				Labels:    map[string]string{"file": watch.path, "pattern": name},
+			})
+		}
+	}
+
+	if err := t.saveOffsets(); err != nil {
+		errors = append(errors, err)
+	}
+	return metrics, errors
+}
+
+// tail counts the matches in the complete lines written since the saved offset.
+// A new inode means the file was rotated and a smaller size that it was truncated,
+// in both cases reading restarts from the beginning. Files seen for the first time
+// start at their end so existing history is not counted.
+func (t *LogTailer) tail(watch tailedLog) ([]int, error) {
+	counts := make([]int, len(watch.patterns))
+
+	file, err := os.Open(watch.path)
+	if err != nil {
+		return counts, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return counts, err
+	}
+
+	inode := fileInode(info)
+	saved, known := t.offsets[watch.path]
+	offset := saved.Offset
+	switch {
+	case !known:
+		offset = info.Size()
+	case saved.Inode != inode || info.Size() < saved.Offset:
+		offset = 0
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return counts, err
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break // partial lines are read again once completed
+		}
+		if err != nil {
+			return counts, err
+		}
+		offset += int64(len(line))
+
+		line = bytes.TrimRight(line, "\r\n")
+		for i, pattern := range watch.patterns {
+			if pattern.Match(line) {
+				counts[i]++
+			}
+		}
+	}
+
+	t.offsets[watch.path] = LogOffset{Inode: inode, Offset: offset}
+	return counts, nil
+}
+
+// saveOffsets atomically replaces the offsets file.
+func (t *LogTailer) saveOffsets() error {
+	if err := os.MkdirAll(filepath.Dir(t.offsetsPath), storageDirMode); err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
+
+	data, err := json.Marshal(t.offsets)
+	if err != nil {
+		return fmt.Errorf("error encoding log offsets: %w", err)
+	}
+	tmpPath := t.offsetsPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, storageFileMode); err != nil {
+		return fmt.Errorf("error writing log offsets: %w", err)
+	}
+	if err := os.Rename(tmpPath, t.offsetsPath); err != nil {
+		return fmt.Errorf("error saving log offsets: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func appendToFile(t *testing.T, path, data string) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = file.WriteString(data)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+}
+
+func patternCounts(t *testing.T, tailer *LogTailer) map[string]float64 {
+	t.Helper()
+	metrics, errors := tailer.Collect(time.Now())
+	require.Empty(t, errors)
+
+	counts := map[string]float64{}
+	for _, m := range metrics {
+		assert.Equal(t, "log_pattern_matches", m.Metric)
+		counts[m.Labels["pattern"]] = m.Value
+	}
+	return counts
+}
+
+func newTestLogTailer(t *testing.T, dir, logPath string) *LogTailer {
+	t.Helper()
+	tailer, err := NewLogTailer([]LogWatch{{
+		Path:     logPath,
+		Patterns: map[string]string{"error": "ERROR", "oom": "(?i)out of memory"},
+	}}, filepath.Join(dir, logOffsetsFileName))
+	require.NoError(t, err)
+	return tailer
+}
+
+func TestLogTailer_CountsNewLines(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+	appendToFile(t, logPath, "ERROR existing history\n")
+
+	tailer := newTestLogTailer(t, dir, logPath)
+	assert.Equal(t, map[string]float64{"error": 0, "oom": 0}, patternCounts(t, tailer))
+
+	appendToFile(t, logPath, "INFO ok\nERROR failed\nkernel: Out of memory: Killed process\nERROR partial")
+	assert.Equal(t, map[string]float64{"error": 1, "oom": 1}, patternCounts(t, tailer))
+
+	appendToFile(t, logPath, " line completed\n")
+	assert.Equal(t, map[string]float64{"error": 1, "oom": 0}, patternCounts(t, tailer))
+}
+
+func TestLogTailer_PersistsOffsetsAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+	appendToFile(t, logPath, "")
+
+	tailer := newTestLogTailer(t, dir, logPath)
+	patternCounts(t, tailer)
+	appendToFile(t, logPath, "ERROR one\n")
+	assert.Equal(t, 1.0, patternCounts(t, tailer)["error"])
+
+	appendToFile(t, logPath, "ERROR two\n")
+	restarted := newTestLogTailer(t, dir, logPath)
+	assert.Equal(t, 1.0, patternCounts(t, restarted)["error"])
+}
+
+func TestLogTailer_Truncation(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+	appendToFile(t, logPath, "INFO a long line that makes the file bigger\n")
+
+	tailer := newTestLogTailer(t, dir, logPath)
+	patternCounts(t, tailer)
+
+	require.NoError(t, os.WriteFile(logPath, []byte("ERROR\n"), 0o644))
+	assert.Equal(t, 1.0, patternCounts(t, tailer)["error"])
+}
+
+func TestLogTailer_Rotation(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("rotation is detected through inodes")
+	}
+
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+	appendToFile(t, logPath, "INFO before rotation\n")
+
+	tailer := newTestLogTailer(t, dir, logPath)
+	patternCounts(t, tailer)
+
+	require.NoError(t, os.Rename(logPath, logPath+".1"))
+	appendToFile(t, logPath, "ERROR after rotation, a longer line than before\nERROR again\n")
+	assert.Equal(t, 2.0, patternCounts(t, tailer)["error"])
+}
+
+func TestLogTailer_MissingFileAndInvalidPattern(t *testing.T) {
+	dir := t.TempDir()
+
+	tailer := newTestLogTailer(t, dir, filepath.Join(dir, "missing.log"))
+	metrics, errors := tailer.Collect(time.Now())
+	assert.Empty(t, metrics)
+	require.Len(t, errors, 1)
+
+	_, err := NewLogTailer([]LogWatch{{Path: "x.log", Patterns: map[string]string{"bad": "("}}}, filepath.Join(dir, logOffsetsFileName))
+	require.Error(t, err)
+}
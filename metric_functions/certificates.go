@@ -0,0 +1,155 @@
+package metric_functions
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CertificateInfo describes a certificate and whether its chain validates.
+type CertificateInfo struct {
+	Source        string
+	Subject       string
+	Issuer        string
+	Serial        string
+	NotAfter      time.Time
+	DaysRemaining float64
+	KeySizeBits   int
+	ChainValid    bool
+	ChainErr      error
+}
+
+// InspectEndpointCertificate performs a TLS handshake with address using serverName for SNI
+// and inspects the leaf certificate at now. roots is used to validate the chain, nil means the system pool.
+func InspectEndpointCertificate(address, serverName string, timeout time.Duration, roots *x509.CertPool, now time.Time) (CertificateInfo, error) {
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return CertificateInfo{}, fmt.Errorf("invalid address %q: %w", address, err)
+		}
+		serverName = host
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	// Verification is done below so expired or untrusted certificates can still be reported.
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		return CertificateInfo{}, fmt.Errorf("error connecting to %s: %w", address, err)
+	}
+	defer conn.Close()
+
+	peers := conn.ConnectionState().PeerCertificates
+	if len(peers) == 0 {
+		return CertificateInfo{}, fmt.Errorf("no certificate presented by %s", address)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range peers[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, verifyErr := peers[0].Verify(x509.VerifyOptions{DNSName: serverName, Roots: roots, Intermediates: intermediates, CurrentTime: now})
+	return newCertificateInfo(address, peers[0], verifyErr, now), nil
+}
+
+// InspectCertificateFiles inspects at now every PEM certificate in the files matching pattern.
+// The other certificates of a file are used as intermediates when validating each chain. Files
+// that cannot be read or hold no valid certificate are reported in the error, the others are
+// still inspected.
+func InspectCertificateFiles(pattern string, roots *x509.CertPool, now time.Time) ([]CertificateInfo, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no certificate files match %q", pattern)
+	}
+
+	var infos []CertificateInfo
+	var errs []error
+	for _, path := range paths {
+		certs, err := readPEMCertificates(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs {
+			intermediates.AddCert(cert)
+		}
+		for _, cert := range certs {
+			_, verifyErr := cert.Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+				CurrentTime:   now,
+			})
+			infos = append(infos, newCertificateInfo(path, cert, verifyErr, now))
+		}
+	}
+	return infos, errors.Join(errs...)
+}
+
+func readPEMCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing certificate in %s: %w", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM certificate found in %s", path)
+	}
+	return certs, nil
+}
+
+func newCertificateInfo(source string, cert *x509.Certificate, verifyErr error, now time.Time) CertificateInfo {
+	return CertificateInfo{
+		Source:        source,
+		Subject:       cert.Subject.String(),
+		Issuer:        cert.Issuer.String(),
+		Serial:        cert.SerialNumber.Text(16),
+		NotAfter:      cert.NotAfter,
+		DaysRemaining: cert.NotAfter.Sub(now).Hours() / 24,
+		KeySizeBits:   publicKeySize(cert.PublicKey),
+		ChainValid:    verifyErr == nil,
+		ChainErr:      verifyErr,
+	}
+}
+
+func publicKeySize(key interface{}) int {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return 256
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,200 @@
+package metric_functions
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	der  []byte
+	key  interface{}
+}
+
+func (c testCertificate) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+}
+
+func newTestCA(t *testing.T) testCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return testCertificate{cert: cert, der: der, key: key}
+}
+
+func newTestLeaf(t *testing.T, ca testCertificate, dnsName string, notAfter time.Time) testCertificate {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return testCertificate{cert: cert, der: der, key: key}
+}
+
+func startTLSServer(t *testing.T, leaf testCertificate) string {
+	t.Helper()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{leaf.der}, PrivateKey: leaf.key}},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestInspectEndpointCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	leaf := newTestLeaf(t, ca, "api.internal.test", time.Now().Add(30*24*time.Hour))
+	address := startTLSServer(t, leaf)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	info, err := InspectEndpointCertificate(address, "api.internal.test", time.Second, roots, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, address, info.Source)
+	assert.Equal(t, "CN=api.internal.test", info.Subject)
+	assert.Equal(t, "CN=Test Root CA", info.Issuer)
+	assert.InDelta(t, 30, info.DaysRemaining, 0.1)
+	assert.Equal(t, 2048, info.KeySizeBits)
+	assert.True(t, info.ChainValid)
+	assert.NoError(t, info.ChainErr)
+}
+
+func TestInspectEndpointCertificate_InvalidChain(t *testing.T) {
+	ca := newTestCA(t)
+	leaf := newTestLeaf(t, ca, "api.internal.test", time.Now().Add(30*24*time.Hour))
+	address := startTLSServer(t, leaf)
+
+	untrusted, err := InspectEndpointCertificate(address, "api.internal.test", time.Second, x509.NewCertPool(), time.Now())
+	require.NoError(t, err)
+	assert.False(t, untrusted.ChainValid)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	wrongName, err := InspectEndpointCertificate(address, "other.internal.test", time.Second, roots, time.Now())
+	require.NoError(t, err)
+	assert.False(t, wrongName.ChainValid)
+}
+
+func TestInspectCertificateFiles(t *testing.T) {
+	ca := newTestCA(t)
+	expired := newTestLeaf(t, ca, "old.internal.test", time.Now().Add(-48*time.Hour))
+	valid := newTestLeaf(t, ca, "new.internal.test", time.Now().Add(90*24*time.Hour))
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "old.pem"), expired.pem(), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "new.pem"), append(valid.pem(), ca.pem()...), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a certificate"), 0o644))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	infos, err := InspectCertificateFiles(filepath.Join(dir, "*.pem"), roots, time.Now())
+	require.NoError(t, err)
+	require.Len(t, infos, 3)
+
+	byPathAndSubject := map[string]CertificateInfo{}
+	for _, info := range infos {
+		byPathAndSubject[filepath.Base(info.Source)+" "+info.Subject] = info
+	}
+
+	old := byPathAndSubject["old.pem CN=old.internal.test"]
+	assert.InDelta(t, -2, old.DaysRemaining, 0.1)
+	assert.False(t, old.ChainValid)
+
+	current := byPathAndSubject["new.pem CN=new.internal.test"]
+	assert.InDelta(t, 90, current.DaysRemaining, 0.1)
+	assert.True(t, current.ChainValid)
+
+	root := byPathAndSubject["new.pem CN=Test Root CA"]
+	assert.Equal(t, 256, root.KeySizeBits)
+}
+
+func TestInspectCertificateFiles_Errors(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := InspectCertificateFiles(filepath.Join(dir, "*.pem"), nil, time.Now())
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "empty.pem"), []byte("nothing here"), 0o644))
+	_, err = InspectCertificateFiles(filepath.Join(dir, "empty.pem"), nil, time.Now())
+	require.Error(t, err)
+}
+
+func TestInspectCertificateFiles_ContinuesAfterInvalidFile(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a-broken.pem"), []byte("nothing here"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b-ca.pem"), ca.pem(), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "c-broken.pem"), []byte("nothing either"), 0o644))
+
+	infos, err := InspectCertificateFiles(filepath.Join(dir, "*.pem"), nil, time.Now())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "a-broken.pem")
+	assert.Contains(t, err.Error(), "c-broken.pem")
+	require.Len(t, infos, 1)
+	assert.Equal(t, "CN=Test Root CA", infos[0].Subject)
+}
+
+func TestInspectCertificateFiles_UsesGivenTime(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ca.pem"), ca.pem(), 0o644))
+
+	infos, err := InspectCertificateFiles(filepath.Join(dir, "ca.pem"), nil, ca.cert.NotAfter.Add(-10*24*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, 10.0, infos[0].DaysRemaining)
+}
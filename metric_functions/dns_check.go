@@ -0,0 +1,132 @@
+package metric_functions
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DNSProbe describes a DNS resolution check against an optional resolver.
+type DNSProbe struct {
+	Name       string
+	RecordType string   // A, AAAA, CNAME, MX, NS or TXT, defaults to A
+	Resolver   string   // host:port of the resolver, the system resolver when empty
+	Expected   []string // Records that must be present in the answer
+	Timeout    time.Duration
+}
+
+// DNSProbeResult holds the outcome of a DNSProbe.
+type DNSProbeResult struct {
+	Up      bool
+	Latency time.Duration
+	Records []string
+	Err     error
+}
+
+// Run resolves the name and checks that every expected record is in the answer.
+func (p DNSProbe) Run() DNSProbeResult {
+	var result DNSProbeResult
+
+	ctx := context.Background()
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	resolver := net.DefaultResolver
+	if p.Resolver != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, p.Resolver)
+			},
+		}
+	}
+
+	start := time.Now()
+	records, err := lookupRecords(ctx, resolver, strings.ToUpper(p.RecordType), p.Name)
+	result.Latency = time.Since(start)
+	if err != nil {
+		result.Err = fmt.Errorf("error resolving %s: %w", p.Name, err)
+		return result
+	}
+	result.Records = records
+
+	for _, expected := range p.Expected {
+		if !containsRecord(records, expected) {
+			result.Err = fmt.Errorf("expected record %q not found in %v", expected, records)
+			return result
+		}
+	}
+
+	result.Up = true
+	return result
+}
+
+func lookupRecords(ctx context.Context, resolver *net.Resolver, recordType, name string) ([]string, error) {
+	var records []string
+	switch recordType {
+	case "", "A", "AAAA":
+		network := "ip4"
+		if recordType == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := resolver.LookupIP(ctx, network, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			records = append(records, ip.String())
+		}
+	case "CNAME":
+		cname, err := resolver.LookupCNAME(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, cname)
+	case "MX":
+		mxs, err := resolver.LookupMX(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, mx := range mxs {
+			records = append(records, mx.Host)
+		}
+	case "NS":
+		nss, err := resolver.LookupNS(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ns := range nss {
+			records = append(records, ns.Host)
+		}
+	case "TXT":
+		txts, err := resolver.LookupTXT(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, txts...)
+	default:
+		return nil, fmt.Errorf("unsupported record type: %s", recordType)
+	}
+	sort.Strings(records)
+	return records, nil
+}
+
+// containsRecord compares records case-insensitively and ignoring the trailing dot of names.
+func containsRecord(records []string, expected string) bool {
+	normalize := func(record string) string {
+		return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(record)), ".")
+	}
+	for _, record := range records {
+		if normalize(record) == normalize(expected) {
+			return true
+		}
+	}
+	return false
+}
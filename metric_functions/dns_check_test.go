@@ -0,0 +1,162 @@
+package metric_functions
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	dnsTypeA   = 1
+	dnsTypeTXT = 16
+)
+
+// startDNSStub answers A and TXT queries over UDP from the given records,
+// keyed by lower-case name without the trailing dot.
+func startDNSStub(t *testing.T, a map[string]string, txt map[string]string) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := dnsStubAnswer(buf[:n], a, txt); resp != nil {
+				_, _ = conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func dnsStubAnswer(query []byte, a map[string]string, txt map[string]string) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+
+	// Parse the single question following the header.
+	var labels []string
+	pos := 12
+	for pos < len(query) && query[pos] != 0 {
+		length := int(query[pos])
+		if pos+1+length > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[pos+1:pos+1+length]))
+		pos += 1 + length
+	}
+	pos++
+	if pos+4 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[pos:])
+	question := query[12 : pos+4]
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	var rdata [][]byte
+	switch qtype {
+	case dnsTypeA:
+		if ip, ok := a[name]; ok {
+			rdata = append(rdata, net.ParseIP(ip).To4())
+		}
+	case dnsTypeTXT:
+		if value, ok := txt[name]; ok {
+			rdata = append(rdata, append([]byte{byte(len(value))}, value...))
+		}
+	}
+
+	resp := make([]byte, 12, 512)
+	copy(resp, query[:2])
+	binary.BigEndian.PutUint16(resp[2:], 0x8180) // response, recursion desired and available
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(rdata)))
+	if len(rdata) == 0 && a[name] == "" && txt[name] == "" {
+		binary.BigEndian.PutUint16(resp[2:], 0x8183) // NXDOMAIN
+	}
+	resp = append(resp, question...)
+	for _, data := range rdata {
+		record := make([]byte, 12)
+		binary.BigEndian.PutUint16(record[0:], 0xC00C) // pointer to the question name
+		binary.BigEndian.PutUint16(record[2:], qtype)
+		binary.BigEndian.PutUint16(record[4:], 1) // IN
+		binary.BigEndian.PutUint32(record[6:], 60)
+		binary.BigEndian.PutUint16(record[10:], uint16(len(data)))
+		resp = append(resp, record...)
+		resp = append(resp, data...)
+	}
+	return resp
+}
+
+func TestDNSProbe_ARecord(t *testing.T) {
+	resolver := startDNSStub(t, map[string]string{"db.internal.test": "10.0.0.5"}, nil)
+
+	result := DNSProbe{
+		Name:     "db.internal.test.",
+		Resolver: resolver,
+		Expected: []string{"10.0.0.5"},
+		Timeout:  2 * time.Second,
+	}.Run()
+
+	require.NoError(t, result.Err)
+	assert.True(t, result.Up)
+	assert.Equal(t, []string{"10.0.0.5"}, result.Records)
+}
+
+func TestDNSProbe_UnexpectedRecord(t *testing.T) {
+	resolver := startDNSStub(t, map[string]string{"db.internal.test": "10.0.0.6"}, nil)
+
+	result := DNSProbe{
+		Name:     "db.internal.test.",
+		Resolver: resolver,
+		Expected: []string{"10.0.0.5"},
+		Timeout:  2 * time.Second,
+	}.Run()
+
+	require.Error(t, result.Err)
+	assert.False(t, result.Up)
+	assert.Equal(t, []string{"10.0.0.6"}, result.Records)
+}
+
+func TestDNSProbe_TXTRecord(t *testing.T) {
+	resolver := startDNSStub(t, nil, map[string]string{"internal.test": "v=spf1 -all"})
+
+	result := DNSProbe{
+		Name:       "internal.test.",
+		RecordType: "txt",
+		Resolver:   resolver,
+		Expected:   []string{"v=spf1 -all"},
+		Timeout:    2 * time.Second,
+	}.Run()
+
+	require.NoError(t, result.Err)
+	assert.True(t, result.Up)
+}
+
+func TestDNSProbe_NXDomain(t *testing.T) {
+	resolver := startDNSStub(t, nil, nil)
+
+	result := DNSProbe{Name: "missing.internal.test.", Resolver: resolver, Timeout: 2 * time.Second}.Run()
+
+	require.Error(t, result.Err)
+	assert.False(t, result.Up)
+}
+
+func TestDNSProbe_UnsupportedType(t *testing.T) {
+	t.Parallel()
+
+	result := DNSProbe{Name: "internal.test.", RecordType: "SRV"}.Run()
+
+	require.Error(t, result.Err)
+	assert.Contains(t, result.Err.Error(), "unsupported record type")
+}
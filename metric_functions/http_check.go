@@ -0,0 +1,119 @@
+package metric_functions
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxProbeBodyBytes caps how much of a response body is matched against BodyPattern.
+const maxProbeBodyBytes = 1 << 20
+
+// HTTPProbe describes a single synthetic HTTP(S) request.
+type HTTPProbe struct {
+	Method          string
+	URL             string
+	Headers         map[string]string
+	ExpectedStatus  int
+	BodyPattern     *regexp.Regexp
+	Timeout         time.Duration
+	TLSClientConfig *tls.Config
+}
+
+// HTTPProbeResult holds the outcome and timing breakdown of an HTTPProbe.
+type HTTPProbeResult struct {
+	Up         bool
+	StatusCode int
+	Total      time.Duration
+	DNS        time.Duration
+	Connect    time.Duration
+	TLS        time.Duration
+	TTFB       time.Duration
+	Err        error
+}
+
+// Run performs the request on a fresh connection and reports whether the
+// response matched the expected status and body pattern.
+func (p HTTPProbe) Run() HTTPProbeResult {
+	var result HTTPProbeResult
+	var dnsStart, connectStart, tlsStart time.Time
+
+	method := p.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequest(method, p.URL, nil)
+	if err != nil {
+		result.Err = fmt.Errorf("error creating request: %w", err)
+		return result
+	}
+	for key, value := range p.Headers {
+		if strings.EqualFold(key, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(key, value)
+	}
+
+	start := time.Now()
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:           func(httptrace.DNSDoneInfo) { result.DNS = time.Since(dnsStart) },
+		ConnectStart:      func(string, string) { connectStart = time.Now() },
+		ConnectDone:       func(string, string, error) { result.Connect = time.Since(connectStart) },
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { result.TLS = time.Since(tlsStart) },
+		GotFirstResponseByte: func() {
+			result.TTFB = time.Since(start)
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	client := &http.Client{
+		Timeout: p.Timeout,
+		Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   p.TLSClientConfig,
+			DisableKeepAlives: true,
+		},
+		// Redirects are reported as-is so the expected status can target them.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Total = time.Since(start)
+		result.Err = fmt.Errorf("error sending request: %w", err)
+		return result
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxProbeBodyBytes))
+	result.Total = time.Since(start)
+	result.StatusCode = resp.StatusCode
+	if err != nil {
+		result.Err = fmt.Errorf("error reading response body: %w", err)
+		return result
+	}
+
+	expected := p.ExpectedStatus
+	if expected == 0 {
+		expected = http.StatusOK
+	}
+	if resp.StatusCode != expected {
+		result.Err = fmt.Errorf("unexpected status code: %d (expected %d)", resp.StatusCode, expected)
+		return result
+	}
+	if p.BodyPattern != nil && !p.BodyPattern.Match(body) {
+		result.Err = fmt.Errorf("response body does not match %q", p.BodyPattern.String())
+		return result
+	}
+
+	result.Up = true
+	return result
+}
@@ -0,0 +1,96 @@
+package metric_functions
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPProbe_Up(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodHead, r.Method)
+		assert.Equal(t, "probe", r.Header.Get("X-Check"))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+
+	result := HTTPProbe{
+		Method:         http.MethodHead,
+		URL:            server.URL,
+		Headers:        map[string]string{"X-Check": "probe"},
+		ExpectedStatus: http.StatusNoContent,
+		Timeout:        time.Second,
+	}.Run()
+
+	require.NoError(t, result.Err)
+	assert.True(t, result.Up)
+	assert.Equal(t, http.StatusNoContent, result.StatusCode)
+	assert.Greater(t, result.Total, time.Duration(0))
+	assert.Greater(t, result.TTFB, time.Duration(0))
+	assert.LessOrEqual(t, result.TTFB, result.Total)
+}
+
+func TestHTTPProbe_UnexpectedStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+
+	result := HTTPProbe{URL: server.URL, Timeout: time.Second}.Run()
+
+	require.Error(t, result.Err)
+	assert.False(t, result.Up)
+	assert.Equal(t, http.StatusServiceUnavailable, result.StatusCode)
+}
+
+func TestHTTPProbe_BodyPattern(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"status":"degraded"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	ok := HTTPProbe{URL: server.URL, BodyPattern: regexp.MustCompile(`"status":"(ok|degraded)"`), Timeout: time.Second}.Run()
+	assert.True(t, ok.Up)
+
+	mismatch := HTTPProbe{URL: server.URL, BodyPattern: regexp.MustCompile(`"status":"ok"`), Timeout: time.Second}.Run()
+	assert.False(t, mismatch.Up)
+	require.Error(t, mismatch.Err)
+	assert.Contains(t, mismatch.Err.Error(), "does not match")
+}
+
+func TestHTTPProbe_Timeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	t.Cleanup(server.Close)
+
+	result := HTTPProbe{URL: server.URL, Timeout: 50 * time.Millisecond}.Run()
+
+	require.Error(t, result.Err)
+	assert.False(t, result.Up)
+	assert.Zero(t, result.StatusCode)
+}
+
+func TestHTTPProbe_TLSTimings(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	result := HTTPProbe{
+		URL:             server.URL,
+		Timeout:         time.Second,
+		TLSClientConfig: &tls.Config{RootCAs: server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs},
+	}.Run()
+
+	require.NoError(t, result.Err)
+	assert.True(t, result.Up)
+	assert.Greater(t, result.Connect, time.Duration(0))
+	assert.Greater(t, result.TLS, time.Duration(0))
+}
@@ -0,0 +1,81 @@
+package metric_functions
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+)
+
+// maxBannerBytes caps how much data is read while waiting for the expected string.
+const maxBannerBytes = 64 * 1024
+
+// TCPProbe describes a TCP connect check, optionally matching a banner or reply.
+type TCPProbe struct {
+	Address string
+	Send    string
+	Expect  string
+	Timeout time.Duration
+}
+
+// TCPProbeResult holds the outcome of a TCPProbe.
+type TCPProbeResult struct {
+	Up      bool
+	Latency time.Duration
+	Err     error
+}
+
+// Run connects to the address, writes Send when set and, when Expect is set,
+// reads until the expected string shows up or the timeout expires.
+func (p TCPProbe) Run() TCPProbeResult {
+	var result TCPProbeResult
+
+	start := time.Now()
+	deadline := start.Add(p.Timeout)
+	conn, err := net.DialTimeout("tcp", p.Address, p.Timeout)
+	if err != nil {
+		result.Latency = time.Since(start)
+		result.Err = fmt.Errorf("error connecting: %w", err)
+		return result
+	}
+	defer conn.Close()
+	if p.Timeout > 0 {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if p.Send != "" {
+		if _, err := conn.Write([]byte(p.Send)); err != nil {
+			result.Latency = time.Since(start)
+			result.Err = fmt.Errorf("error writing: %w", err)
+			return result
+		}
+	}
+
+	if p.Expect != "" {
+		if err := readUntil(conn, []byte(p.Expect)); err != nil {
+			result.Latency = time.Since(start)
+			result.Err = err
+			return result
+		}
+	}
+
+	result.Latency = time.Since(start)
+	result.Up = true
+	return result
+}
+
+func readUntil(conn net.Conn, expect []byte) error {
+	var received []byte
+	buf := make([]byte, 4096)
+	for len(received) < maxBannerBytes {
+		n, err := conn.Read(buf)
+		received = append(received, buf[:n]...)
+		if bytes.Contains(received, expect) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("expected %q not received: %w", expect, err)
+		}
+	}
+	return fmt.Errorf("expected %q not received in the first %d bytes", expect, maxBannerBytes)
+}
@@ -0,0 +1,84 @@
+package metric_functions
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTCPServer accepts connections and hands each one to handle.
+func startTCPServer(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestTCPProbe_Connect(t *testing.T) {
+	address := startTCPServer(t, func(net.Conn) {})
+
+	result := TCPProbe{Address: address, Timeout: time.Second}.Run()
+
+	require.NoError(t, result.Err)
+	assert.True(t, result.Up)
+	assert.Greater(t, result.Latency, time.Duration(0))
+}
+
+func TestTCPProbe_Banner(t *testing.T) {
+	address := startTCPServer(t, func(conn net.Conn) {
+		_, _ = conn.Write([]byte("220 smtp.internal ESMTP ready\r\n"))
+	})
+
+	ok := TCPProbe{Address: address, Expect: "ESMTP", Timeout: time.Second}.Run()
+	require.NoError(t, ok.Err)
+	assert.True(t, ok.Up)
+
+	mismatch := TCPProbe{Address: address, Expect: "+OK", Timeout: 200 * time.Millisecond}.Run()
+	require.Error(t, mismatch.Err)
+	assert.False(t, mismatch.Up)
+}
+
+func TestTCPProbe_SendAndExpect(t *testing.T) {
+	address := startTCPServer(t, func(conn net.Conn) {
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err == nil && line == "PING\r\n" {
+			_, _ = conn.Write([]byte("+PONG\r\n"))
+		}
+	})
+
+	result := TCPProbe{Address: address, Send: "PING\r\n", Expect: "+PONG", Timeout: time.Second}.Run()
+
+	require.NoError(t, result.Err)
+	assert.True(t, result.Up)
+}
+
+func TestTCPProbe_ConnectionRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	result := TCPProbe{Address: address, Timeout: time.Second}.Run()
+
+	require.Error(t, result.Err)
+	assert.False(t, result.Up)
+}
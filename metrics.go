@@ -15,6 +15,14 @@ import (
 	"github.com/shirou/gopsutil/net"
 )
 
+// cumulativeMetrics lists the collected metrics that only grow since boot.
+var cumulativeMetrics = map[string]bool{
+	"net_sent_b": true,
+	"net_recv_b": true,
+	"pkt_sent":   true,
+	"pkt_recv":   true,
+}
+
 func collectMetrics() ([]Metric, []error) {
 	now := time.Now().UTC().Format(time.RFC3339)
 	var metrics []Metric
@@ -74,6 +82,13 @@ func collectMetrics() ([]Metric, []error) {
 		})
 	}
 
+	// Log patterns
+	if logTailer != nil {
+		logMetrics, logErrors := logTailer.Collect(time.Now())
+		metrics = append(metrics, logMetrics...)
+		errors = append(errors, logErrors...)
+	}
+
 	// Return metrics and any errors encountered
 	return metrics, errors
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	formatOTLP     = "otlp"      // OTLP/HTTP with protobuf bodies
+	formatOTLPJSON = "otlp_json" // OTLP/HTTP with JSON bodies
+
+	otlpMetricsPath     = "v1/metrics"
+	otlpScopeName       = "uptinio-server-agent"
+	otlpCumulative      = 2 // AGGREGATION_TEMPORALITY_CUMULATIVE
+	protobufContentType = "application/x-protobuf"
+)
+
+// otlpRequest converts the payload into an OTLP export request. The attributes describe the
+// resource, the metrics become data points grouped by name, as sums for counters and as
+// gauges otherwise, with their labels as point attributes.
+func otlpRequest(payload Payload) OTLPMetricsRequest {
+	var metrics []OTLPMetric
+	index := make(map[string]int)
+	for _, m := range payload.Metrics {
+		point := OTLPDataPoint{
+			Attributes:   otlpAttributes(m.Labels),
+			TimeUnixNano: uint64(metricTime(m).UnixNano()),
+			AsDouble:     m.Value,
+		}
+		i, ok := index[m.Metric]
+		if !ok {
+			i = len(metrics)
+			index[m.Metric] = i
+			metric := OTLPMetric{Name: m.Metric}
+			if prometheusType(m.Metric) == "counter" {
+				metric.Sum = &OTLPSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+			} else {
+				metric.Gauge = &OTLPGauge{}
+			}
+			metrics = append(metrics, metric)
+		}
+		if metrics[i].Sum != nil {
+			metrics[i].Sum.DataPoints = append(metrics[i].Sum.DataPoints, point)
+		} else {
+			metrics[i].Gauge.DataPoints = append(metrics[i].Gauge.DataPoints, point)
+		}
+	}
+
+	return OTLPMetricsRequest{ResourceMetrics: []OTLPResourceMetrics{{
+		Resource: OTLPResource{Attributes: otlpAttributes(payload.Attributes)},
+		ScopeMetrics: []OTLPScopeMetrics{{
+			Scope:   OTLPScope{Name: otlpScopeName, Version: payload.Version},
+			Metrics: metrics,
+		}},
+	}}}
+}
+
+// metricTime returns the time of the metric, the current time when it cannot be parsed.
+func metricTime(m Metric) time.Time {
+	timestamp, err := time.Parse(time.RFC3339, m.Timestamp)
+	if err != nil {
+		return time.Now()
+	}
+	return timestamp
+}
+
+// otlpAttributes converts a map of attributes, sorted by key. Values of other types than
+// strings, booleans and numbers are formatted as strings.
+func otlpAttributes[V any](attributes map[string]V) []OTLPKeyValue {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]OTLPKeyValue, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, OTLPKeyValue{Key: key, Value: otlpValue(attributes[key])})
+	}
+	return result
+}
+
+func otlpValue(value any) OTLPAnyValue {
+	switch v := value.(type) {
+	case string:
+		return OTLPAnyValue{StringValue: &v}
+	case bool:
+		return OTLPAnyValue{BoolValue: &v}
+	case int:
+		i := int64(v)
+		return OTLPAnyValue{IntValue: &i}
+	case int64:
+		return OTLPAnyValue{IntValue: &v}
+	case uint64:
+		if v <= math.MaxInt64 {
+			i := int64(v)
+			return OTLPAnyValue{IntValue: &i}
+		}
+	case float64:
+		return OTLPAnyValue{DoubleValue: &v}
+	}
+	s := fmt.Sprint(value)
+	return OTLPAnyValue{StringValue: &s}
+}
+
+// marshalProto encodes the request in the protobuf wire format of
+// opentelemetry.proto.collector.metrics.v1.ExportMetricsServiceRequest.
+func (r OTLPMetricsRequest) marshalProto() []byte {
+	var b []byte
+	for _, rm := range r.ResourceMetrics {
+		b = appendMessage(b, 1, rm.marshalProto())
+	}
+	return b
+}
+
+func (rm OTLPResourceMetrics) marshalProto() []byte {
+	var resource []byte
+	for _, kv := range rm.Resource.Attributes {
+		resource = appendMessage(resource, 1, kv.marshalProto())
+	}
+	b := appendMessage(nil, 1, resource)
+	for _, sm := range rm.ScopeMetrics {
+		b = appendMessage(b, 2, sm.marshalProto())
+	}
+	return b
+}
+
+func (sm OTLPScopeMetrics) marshalProto() []byte {
+	var scope []byte
+	scope = appendString(scope, 1, sm.Scope.Name)
+	scope = appendString(scope, 2, sm.Scope.Version)
+	b := appendMessage(nil, 1, scope)
+	for _, m := range sm.Metrics {
+		b = appendMessage(b, 2, m.marshalProto())
+	}
+	return b
+}
+
+func (m OTLPMetric) marshalProto() []byte {
+	b := appendString(nil, 1, m.Name)
+	switch {
+	case m.Gauge != nil:
+		var gauge []byte
+		for _, point := range m.Gauge.DataPoints {
+			gauge = appendMessage(gauge, 1, point.marshalProto())
+		}
+		b = appendMessage(b, 5, gauge)
+	case m.Sum != nil:
+		var sum []byte
+		for _, point := range m.Sum.DataPoints {
+			sum = appendMessage(sum, 1, point.marshalProto())
+		}
+		sum = protowire.AppendTag(sum, 2, protowire.VarintType)
+		sum = protowire.AppendVarint(sum, uint64(m.Sum.AggregationTemporality))
+		sum = protowire.AppendTag(sum, 3, protowire.VarintType)
+		sum = protowire.AppendVarint(sum, protowire.EncodeBool(m.Sum.IsMonotonic))
+		b = appendMessage(b, 7, sum)
+	}
+	return b
+}
+
+func (p OTLPDataPoint) marshalProto() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 3, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, p.TimeUnixNano)
+	b = protowire.AppendTag(b, 4, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(p.AsDouble))
+	for _, kv := range p.Attributes {
+		b = appendMessage(b, 7, kv.marshalProto())
+	}
+	return b
+}
+
+func (kv OTLPKeyValue) marshalProto() []byte {
+	var value []byte
+	switch v := kv.Value; {
+	case v.StringValue != nil:
+		value = protowire.AppendTag(value, 1, protowire.BytesType)
+		value = protowire.AppendString(value, *v.StringValue)
+	case v.BoolValue != nil:
+		value = protowire.AppendTag(value, 2, protowire.VarintType)
+		value = protowire.AppendVarint(value, protowire.EncodeBool(*v.BoolValue))
+	case v.IntValue != nil:
+		value = protowire.AppendTag(value, 3, protowire.VarintType)
+		value = protowire.AppendVarint(value, uint64(*v.IntValue))
+	case v.DoubleValue != nil:
+		value = protowire.AppendTag(value, 4, protowire.Fixed64Type)
+		value = protowire.AppendFixed64(value, math.Float64bits(*v.DoubleValue))
+	}
+	b := appendString(nil, 1, kv.Key)
+	return appendMessage(b, 2, value)
+}
+
+// appendMessage appends an embedded message field, also when it is empty.
+func appendMessage(b []byte, field protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+// appendString appends a string field, omitting it when empty like proto3 does.
+func appendString(b []byte, field protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoField is a decoded protobuf field, value holds varint and fixed64 values.
+type protoField struct {
+	number protowire.Number
+	value  uint64
+	bytes  []byte
+}
+
+func decodeProto(t *testing.T, b []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(b) > 0 {
+		number, typ, n := protowire.ConsumeTag(b)
+		require.GreaterOrEqual(t, n, 0, "invalid tag")
+		b = b[n:]
+		field := protoField{number: number}
+		switch typ {
+		case protowire.VarintType:
+			field.value, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			field.value, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			field.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+		require.GreaterOrEqual(t, n, 0, "invalid field %d", number)
+		b = b[n:]
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// protoMessages returns the embedded messages of the field with the given number.
+func protoMessages(t *testing.T, b []byte, number protowire.Number) [][]byte {
+	t.Helper()
+	var messages [][]byte
+	for _, field := range decodeProto(t, b) {
+		if field.number == number {
+			messages = append(messages, field.bytes)
+		}
+	}
+	return messages
+}
+
+func otlpTestPayload() Payload {
+	return Payload{
+		Version:    "1.2.3",
+		Attributes: map[string]interface{}{"hostname": "web-1", "cpu_count": 4, "uptime": 12.5},
+		Metrics: []Metric{
+			{Metric: "cpu", Value: 10, Timestamp: "2024-01-01T00:00:00Z", Labels: map[string]string{"core": "0"}},
+			{Metric: "net_sent_b", Value: 1000, Timestamp: "2024-01-01T00:00:00Z"},
+			{Metric: "cpu", Value: 20, Timestamp: "2024-01-01T00:01:00Z", Labels: map[string]string{"core": "0"}},
+		},
+	}
+}
+
+func TestOTLPRequest(t *testing.T) {
+	t.Parallel()
+
+	request := otlpRequest(otlpTestPayload())
+	require.Len(t, request.ResourceMetrics, 1)
+	resource := request.ResourceMetrics[0]
+	require.Len(t, resource.Resource.Attributes, 3)
+	assert.Equal(t, "cpu_count", resource.Resource.Attributes[0].Key)
+	assert.Equal(t, int64(4), *resource.Resource.Attributes[0].Value.IntValue)
+	assert.Equal(t, "web-1", *resource.Resource.Attributes[1].Value.StringValue)
+	assert.Equal(t, 12.5, *resource.Resource.Attributes[2].Value.DoubleValue)
+
+	scope := resource.ScopeMetrics[0]
+	assert.Equal(t, OTLPScope{Name: otlpScopeName, Version: "1.2.3"}, scope.Scope)
+	require.Len(t, scope.Metrics, 2, "points are grouped by metric name")
+	cpu := scope.Metrics[0]
+	require.NotNil(t, cpu.Gauge)
+	require.Len(t, cpu.Gauge.DataPoints, 2)
+	assert.Equal(t, uint64(1704067260000000000), cpu.Gauge.DataPoints[1].TimeUnixNano)
+	assert.Equal(t, "core", cpu.Gauge.DataPoints[1].Attributes[0].Key)
+
+	sent := scope.Metrics[1]
+	require.NotNil(t, sent.Sum, "cumulative metrics are sums")
+	assert.Equal(t, otlpCumulative, sent.Sum.AggregationTemporality)
+	assert.True(t, sent.Sum.IsMonotonic)
+}
+
+func TestOTLPRequest_JSON(t *testing.T) {
+	t.Parallel()
+
+	data, err := json.Marshal(otlpRequest(otlpTestPayload()))
+	require.NoError(t, err)
+	body := string(data)
+	assert.Contains(t, body, `{"key":"cpu_count","value":{"intValue":"4"}}`)
+	assert.Contains(t, body, `"timeUnixNano":"1704067200000000000","asDouble":10`)
+	assert.Contains(t, body, `"sum":{"dataPoints":[{"timeUnixNano":"1704067200000000000","asDouble":1000}],"aggregationTemporality":2,"isMonotonic":true}`)
+}
+
+func TestOTLPRequest_Protobuf(t *testing.T) {
+	t.Parallel()
+
+	body := otlpRequest(otlpTestPayload()).marshalProto()
+	resourceMetrics := protoMessages(t, body, 1)
+	require.Len(t, resourceMetrics, 1)
+
+	resource := protoMessages(t, resourceMetrics[0], 1)[0]
+	attributes := protoMessages(t, resource, 1)
+	require.Len(t, attributes, 3)
+	hostname := decodeProto(t, attributes[1])
+	assert.Equal(t, "hostname", string(hostname[0].bytes))
+	assert.Equal(t, "web-1", string(decodeProto(t, hostname[1].bytes)[0].bytes))
+
+	scopeMetrics := protoMessages(t, resourceMetrics[0], 2)[0]
+	scope := decodeProto(t, protoMessages(t, scopeMetrics, 1)[0])
+	assert.Equal(t, otlpScopeName, string(scope[0].bytes))
+	metrics := protoMessages(t, scopeMetrics, 2)
+	require.Len(t, metrics, 2)
+
+	cpu := decodeProto(t, metrics[0])
+	assert.Equal(t, "cpu", string(cpu[0].bytes))
+	assert.Equal(t, protowire.Number(5), cpu[1].number, "gauge")
+	points := protoMessages(t, cpu[1].bytes, 1)
+	require.Len(t, points, 2)
+	point := decodeProto(t, points[1])
+	assert.Equal(t, uint64(1704067260000000000), point[0].value)
+	assert.Equal(t, 20.0, math.Float64frombits(point[1].value))
+	assert.Equal(t, protowire.Number(7), point[2].number, "labels are point attributes")
+
+	sent := decodeProto(t, metrics[1])
+	assert.Equal(t, protowire.Number(7), sent[1].number, "sum")
+	sum := decodeProto(t, sent[1].bytes)
+	assert.Equal(t, uint64(otlpCumulative), sum[1].value)
+	assert.Equal(t, uint64(1), sum[2].value)
+}
+
+func TestDestination_OTLP(t *testing.T) {
+	var contentType, path string
+	var body []byte
+	configured := setupDestinations(t, func(w http.ResponseWriter, r *http.Request) {
+		contentType, path = r.Header.Get("Content-Type"), r.URL.Path
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	})
+	configured[0].Format = formatOTLP
+	configured[0].Path = defaultPath(formatOTLP)
+
+	require.NoError(t, configured[0].saveMetrics(otlpTestPayload()))
+	require.NoError(t, configured[0].sendQueuedMetrics(), "OTLP receivers answer 200")
+	assert.Equal(t, protobufContentType, contentType)
+	assert.Equal(t, "/v1/metrics", path)
+	assert.Len(t, protoMessages(t, body, 1), 1)
+
+	configured[0].Format = formatOTLPJSON
+	require.NoError(t, configured[0].saveMetrics(otlpTestPayload()))
+	require.NoError(t, configured[0].sendQueuedMetrics())
+	assert.Equal(t, "application/json", contentType)
+	var request OTLPMetricsRequest
+	require.NoError(t, json.Unmarshal(body, &request))
+	assert.Len(t, request.ResourceMetrics[0].ScopeMetrics[0].Metrics, 2)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	prometheusNamespace   = "uptinio"
+	prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// startPrometheusServer serves the latest metrics in Prometheus exposition format on addr.
+func startPrometheusServer(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", prometheusHandler)
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Println("Prometheus endpoint stopped:", err)
+		}
+	}()
+	log.Println("Serving Prometheus metrics at:", listener.Addr().String())
+	return server, nil
+}
+
+func prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", prometheusContentType)
+	_, _ = w.Write([]byte(formatPrometheus(latestMetrics.Load(), agentMetrics.Snapshot())))
+}
+
+// formatPrometheus renders collected metrics and self-metrics in the text exposition format.
+func formatPrometheus(collected, self []Metric) string {
+	var b strings.Builder
+	writePrometheusFamilies(&b, collected)
+	writePrometheusFamilies(&b, self)
+	return b.String()
+}
+
+// writePrometheusFamilies groups metrics sharing a name under a single TYPE line.
+// Only the last sample of each series is kept, since the format allows one value per series.
+func writePrometheusFamilies(b *strings.Builder, metrics []Metric) {
+	families := make(map[string][]string)
+	samples := make(map[string]Metric)
+	var names []string
+	for _, m := range metrics {
+		name := prometheusMetricName(m.Metric)
+		series := name + prometheusLabels(m.Labels)
+		if _, ok := families[name]; !ok {
+			names = append(names, name)
+		}
+		if _, ok := samples[series]; !ok {
+			families[name] = append(families[name], series)
+		}
+		samples[series] = m
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(b, "# TYPE %s %s\n", name, prometheusType(samples[families[name][0]].Metric))
+		for _, series := range families[name] {
+			fmt.Fprintf(b, "%s %s\n", series, strconv.FormatFloat(samples[series].Value, 'g', -1, 64))
+		}
+	}
+}
+
+// prometheusLabels renders labels sorted by key, escaping their values.
+func prometheusLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, key, escaper.Replace(labels[key]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func prometheusType(metric string) string {
+	if cumulativeMetrics[metric] || strings.HasSuffix(metric, "_total") {
+		return "counter"
+	}
+	return "gauge"
+}
+
+// prometheusMetricName prefixes the metric with the namespace and replaces invalid characters.
+func prometheusMetricName(metric string) string {
+	var b strings.Builder
+	b.WriteString(prometheusNamespace)
+	b.WriteByte('_')
+	for _, r := range metric {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == ':' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatPrometheus(t *testing.T) {
+	t.Parallel()
+
+	out := formatPrometheus(
+		[]Metric{
+			{Metric: "cpu_used", Value: 512, Timestamp: "2026-01-01T00:00:00Z"},
+			{Metric: "net_sent_b", Value: 1.5e+09, Timestamp: "2026-01-01T00:00:00Z"},
+		},
+		[]Metric{{Metric: "agent_collections_total", Value: 3}},
+	)
+
+	assert.Contains(t, out, "# TYPE uptinio_cpu_used gauge\nuptinio_cpu_used 512\n")
+	assert.Contains(t, out, "# TYPE uptinio_net_sent_b counter\nuptinio_net_sent_b 1.5e+09\n")
+	assert.Contains(t, out, "# TYPE uptinio_agent_collections_total counter\nuptinio_agent_collections_total 3\n")
+}
+
+func TestFormatPrometheus_Labels(t *testing.T) {
+	t.Parallel()
+
+	out := formatPrometheus([]Metric{
+		{Metric: "check_up", Value: 1, Labels: map[string]string{"type": "http", "check": `say "hi"`}},
+		{Metric: "check_up", Value: 1, Labels: map[string]string{"type": "tcp", "check": "db"}},
+		{Metric: "check_up", Value: 0, Labels: map[string]string{"type": "tcp", "check": "db"}},
+	}, nil)
+
+	assert.Equal(t, "# TYPE uptinio_check_up gauge\n"+
+		`uptinio_check_up{check="say \"hi\"",type="http"} 1`+"\n"+
+		`uptinio_check_up{check="db",type="tcp"} 0`+"\n", out)
+}
+
+func TestPrometheusMetricName(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "uptinio_mem_used_b", prometheusMetricName("mem_used_b"))
+	assert.Equal(t, "uptinio_disk_used_b_root", prometheusMetricName("disk.used-b/root"))
+}
+
+func TestPrometheusHandler_ServesLatestAndSelfMetrics(t *testing.T) {
+	origLatest, origSelf := latestMetrics, agentMetrics
+	latestMetrics = &LatestMetrics{}
+	agentMetrics = NewSelfMetrics()
+	t.Cleanup(func() {
+		latestMetrics = origLatest
+		agentMetrics = origSelf
+	})
+
+	latestMetrics.Store([]Metric{{Metric: "mem_used_b", Value: 1024, Timestamp: "2026-01-01T00:00:00Z"}})
+	agentMetrics.Add("agent_send_failures_total", 2)
+
+	server := httptest.NewServer(http.HandlerFunc(prometheusHandler))
+	t.Cleanup(server.Close)
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, prometheusContentType, resp.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), "uptinio_mem_used_b 1024\n")
+	assert.Contains(t, string(body), "uptinio_agent_send_failures_total 2\n")
+}
+
+func TestStartPrometheusServer(t *testing.T) {
+	server, err := startPrometheusServer("127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+
+	_, err = startPrometheusServer("invalid-address")
+	require.Error(t, err)
+}
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentExtension       = ".seg"
+	ackFileName            = "ack"
+	lockFileName           = "lock"
+	defaultSegmentMaxBytes = 4 * 1024 * 1024
+
+	fsyncAlways = "always"
+	fsyncRotate = "rotate"
+	fsyncNever  = "never"
+
+	// Stored metrics identify the host, keep them private to the agent user.
+	storageDirMode  os.FileMode = 0700
+	storageFileMode os.FileMode = 0600
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	queueLocksMu sync.Mutex
+	queueLocks   = make(map[string]*sync.Mutex)
+)
+
+// openQueue locks dir for the calling goroutine and against other processes, and loads
+// the queue state, truncating a torn record left at the tail of the last segment by a
+// crash. Close releases the lock.
+func openQueue(dir string, options StorageConfig) (*Queue, error) {
+	return lockQueue(dir, options, false)
+}
+
+// inspectQueue opens the queue like openQueue for reading only: damaged records, torn tails
+// and an invalid ack file are skipped but left as they are for the agent to handle.
+func inspectQueue(dir string, options StorageConfig) (*Queue, error) {
+	return lockQueue(dir, options, true)
+}
+
+func lockQueue(dir string, options StorageConfig, readOnly bool) (*Queue, error) {
+	switch options.Fsync {
+	case "":
+		options.Fsync = fsyncAlways
+	case fsyncAlways, fsyncRotate, fsyncNever:
+	default:
+		return nil, fmt.Errorf("invalid fsync policy: %q", options.Fsync)
+	}
+	if !validCompression(options.Compression) {
+		return nil, fmt.Errorf("invalid storage compression: %q", options.Compression)
+	}
+	if options.SegmentMaxBytes <= 0 {
+		options.SegmentMaxBytes = defaultSegmentMaxBytes
+	}
+
+	if err := os.MkdirAll(dir, storageDirMode); err != nil {
+		return nil, fmt.Errorf("error creating directory: %w", err)
+	}
+	// Directories created by older versions were world-readable.
+	if !readOnly {
+		if err := os.Chmod(dir, storageDirMode); err != nil {
+			return nil, fmt.Errorf("error setting directory permissions: %w", err)
+		}
+	}
+
+	q := &Queue{dir: dir, options: options, mu: queueLock(dir), readOnly: readOnly}
+	q.mu.Lock()
+	if err := q.lockDir(); err != nil {
+		q.mu.Unlock()
+		return nil, err
+	}
+	if err := q.load(); err != nil {
+		q.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *Queue) lockDir() error {
+	file, err := os.OpenFile(filepath.Join(q.dir, lockFileName), os.O_CREATE|os.O_RDWR, storageFileMode)
+	if err != nil {
+		return fmt.Errorf("error opening lock file: %w", err)
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return fmt.Errorf("error locking queue: %w", err)
+	}
+	q.lock = file
+	return nil
+}
+
+func queueLock(dir string) *sync.Mutex {
+	queueLocksMu.Lock()
+	defer queueLocksMu.Unlock()
+
+	dir = filepath.Clean(dir)
+	if _, ok := queueLocks[dir]; !ok {
+		queueLocks[dir] = &sync.Mutex{}
+	}
+	return queueLocks[dir]
+}
+
+// Close releases the queue.
+func (q *Queue) Close() {
+	unlockFile(q.lock)
+	q.lock.Close()
+	q.mu.Unlock()
+}
+
+func (q *Queue) load() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("error reading queue directory: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExtension) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, seq)
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	data, err := os.ReadFile(filepath.Join(q.dir, ackFileName))
+	if err == nil {
+		q.ackedSeq, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil && q.readOnly {
+			q.ackedSeq = 0
+		} else if err != nil {
+			// Sending the records again is better than losing or blocking the whole queue.
+			quarantined, qerr := quarantineFile(filepath.Join(q.dir, ackFileName))
+			if qerr != nil {
+				return qerr
+			}
+			q.ackedSeq = 0
+			reportCorruption("invalid ack file in %s, pending records will be sent again, kept at %s", q.dir, quarantined)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("error reading ack file: %w", err)
+	}
+
+	q.nextSeq = q.ackedSeq + 1
+	if len(q.segments) == 0 {
+		return nil
+	}
+
+	last := q.segments[len(q.segments)-1]
+	if last > q.nextSeq {
+		q.nextSeq = last
+	}
+	lastSeq, err := q.recoverSegment(last)
+	if err != nil {
+		return err
+	}
+	if lastSeq >= q.nextSeq {
+		q.nextSeq = lastSeq + 1
+	}
+	return nil
+}
+
+// recoverSegment repairs damaged records followed by intact ones and truncates the torn
+// records at the end of the segment, keeping quarantined copies of what is dropped.
+// It returns the sequence number of the last record.
+func (q *Queue) recoverSegment(first uint64) (uint64, error) {
+	path := q.segmentPath(first)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("error reading segment: %w", err)
+	}
+
+	var lastSeq uint64
+	var validSize int64
+	var offset int64
+	damaged, repair := false, false
+	lines, _ := recordLines(data)
+	for _, line := range lines {
+		offset += int64(len(line))
+		if _, err := decodeFrame(line); err != nil {
+			damaged = true
+			continue
+		}
+		repair = repair || damaged
+		// Records that fail to decode, e.g. encrypted with another key, are intact and kept.
+		// Sequence numbers increase within a segment, so the n-th record has at least first+n.
+		lastSeq = max(lastSeq+1, first)
+		if record, err := decodeRecord(line, q.options.key); err == nil {
+			lastSeq = max(lastSeq, record.Seq)
+		}
+		validSize = offset
+	}
+
+	if q.readOnly {
+		return lastSeq, nil
+	}
+	if repair {
+		return lastSeq, q.repairSegment(first, data)
+	}
+	if int64(len(data)) > validSize {
+		quarantined := quarantinePath(path, time.Now())
+		if err := os.WriteFile(quarantined, data[validSize:], storageFileMode); err != nil {
+			return 0, fmt.Errorf("error quarantining torn records: %w", err)
+		}
+		if err := os.Truncate(path, validSize); err != nil {
+			return 0, fmt.Errorf("error truncating segment: %w", err)
+		}
+		reportCorruption("dropped %d bytes of torn records from queue segment %s, kept at %s", int64(len(data))-validSize, path, quarantined)
+	}
+	return lastSeq, nil
+}
+
+// Append writes the payload as a new record, starting a new segment when the current one is full.
+func (q *Queue) Append(payload Payload) (uint64, error) {
+	return q.Import(QueueRecord{ID: newUUID(), Time: time.Now().UTC(), Payload: payload})
+}
+
+// Import appends a record keeping its ID and time, e.g. one exported from another queue,
+// under the next sequence number.
+func (q *Queue) Import(record QueueRecord) (uint64, error) {
+	record.Seq = q.nextSeq
+	line, err := encodeRecord(record, q.options.Compression, q.options.key)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(q.segments) == 0 {
+		q.segments = append(q.segments, record.Seq)
+	} else {
+		current := q.segments[len(q.segments)-1]
+		info, err := os.Stat(q.segmentPath(current))
+		if err != nil && !os.IsNotExist(err) {
+			return 0, fmt.Errorf("error reading segment: %w", err)
+		}
+		if err == nil && info.Size() > 0 && info.Size()+int64(len(line)) > q.options.SegmentMaxBytes {
+			if q.options.Fsync == fsyncRotate {
+				if err := syncFile(q.segmentPath(current)); err != nil {
+					return 0, err
+				}
+			}
+			q.segments = append(q.segments, record.Seq)
+		}
+	}
+
+	file, err := os.OpenFile(q.segmentPath(q.segments[len(q.segments)-1]), os.O_APPEND|os.O_CREATE|os.O_WRONLY, storageFileMode)
+	if err != nil {
+		return 0, fmt.Errorf("error opening segment: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(line); err != nil {
+		return 0, fmt.Errorf("error writing record: %w", err)
+	}
+	if q.options.Fsync == fsyncAlways {
+		if err := file.Sync(); err != nil {
+			return 0, fmt.Errorf("error syncing segment: %w", err)
+		}
+	}
+
+	q.nextSeq++
+	return record.Seq, nil
+}
+
+// Pending returns up to max unacknowledged records in order, all of them when max is 0.
+// Corrupt records are skipped.
+func (q *Queue) Pending(max int) ([]QueueRecord, error) {
+	var records []QueueRecord
+	for i, first := range q.segments {
+		if i+1 < len(q.segments) && q.segments[i+1]-1 <= q.ackedSeq {
+			continue // fully acknowledged
+		}
+
+		done, err := q.scanSegment(first, func(record QueueRecord, size int) bool {
+			if record.Seq <= q.ackedSeq {
+				return true
+			}
+			records = append(records, record)
+			return max == 0 || len(records) < max
+		})
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			break
+		}
+	}
+	return records, nil
+}
+
+// scanSegment calls fn with each valid record of the segment and its stored size until
+// fn returns false, and reports whether it was stopped. A segment with damaged records or
+// records that cannot be decoded, e.g. encrypted with another key, is repaired unless the
+// queue is read-only.
+func (q *Queue) scanSegment(first uint64, fn func(QueueRecord, int) bool) (bool, error) {
+	path := q.segmentPath(first)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("error reading segment: %w", err)
+	}
+
+	damaged := false
+	lines, _ := recordLines(data)
+	for _, line := range lines {
+		record, err := decodeRecord(line, q.options.key)
+		if err != nil {
+			damaged = true
+			continue
+		}
+		if !fn(record, len(line)) {
+			if damaged && !q.readOnly {
+				return true, q.repairSegment(first, data)
+			}
+			return true, nil
+		}
+	}
+	if damaged && !q.readOnly {
+		return false, q.repairSegment(first, data)
+	}
+	return false, nil
+}
+
+// Ack acknowledges every record up to and including seq and removes the fully acknowledged segments.
+func (q *Queue) Ack(seq uint64) error {
+	if seq <= q.ackedSeq {
+		return nil
+	}
+	if seq >= q.nextSeq {
+		seq = q.nextSeq - 1
+	}
+
+	ackPath := filepath.Join(q.dir, ackFileName)
+	if err := os.WriteFile(ackPath+".tmp", []byte(strconv.FormatUint(seq, 10)), storageFileMode); err != nil {
+		return fmt.Errorf("error writing ack file: %w", err)
+	}
+	if err := os.Rename(ackPath+".tmp", ackPath); err != nil {
+		return fmt.Errorf("error saving ack file: %w", err)
+	}
+	q.ackedSeq = seq
+
+	remaining := q.segments[:0]
+	for i, first := range q.segments {
+		end := q.nextSeq - 1
+		if i+1 < len(q.segments) {
+			end = q.segments[i+1] - 1
+		}
+		if end <= seq {
+			if err := os.Remove(q.segmentPath(first)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("error removing segment: %w", err)
+			}
+			continue
+		}
+		remaining = append(remaining, first)
+	}
+	q.segments = remaining
+	return nil
+}
+
+// Rewrite passes the pending records of each segment to fn and atomically replaces the
+// segment when fn reports a change. fn must keep the records in order and only use sequence
+// numbers of the records it was given. It returns how many segments were rewritten.
+func (q *Queue) Rewrite(fn func([]QueueRecord) ([]QueueRecord, bool)) (int, error) {
+	rewritten := 0
+	for i, first := range q.segments {
+		if i+1 < len(q.segments) && q.segments[i+1]-1 <= q.ackedSeq {
+			continue
+		}
+
+		var records []QueueRecord
+		if _, err := q.scanSegment(first, func(record QueueRecord, size int) bool {
+			if record.Seq > q.ackedSeq {
+				records = append(records, record)
+			}
+			return true
+		}); err != nil {
+			return rewritten, err
+		}
+		if len(records) == 0 {
+			continue
+		}
+
+		replacement, changed := fn(records)
+		if !changed {
+			continue
+		}
+		if err := q.replaceSegment(first, replacement); err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
+
+// replaceSegment writes records to a temporary file and renames it over the segment.
+func (q *Queue) replaceSegment(first uint64, records []QueueRecord) error {
+	path := q.segmentPath(first)
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, storageFileMode)
+	if err != nil {
+		return fmt.Errorf("error creating segment: %w", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, record := range records {
+		line, err := encodeRecord(record, q.options.Compression, q.options.key)
+		if err == nil {
+			_, err = writer.Write(line)
+		}
+		if err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+			return fmt.Errorf("error writing segment: %w", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("error writing segment: %w", err)
+	}
+	if q.options.Fsync != fsyncNever {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+			return fmt.Errorf("error syncing segment: %w", err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error writing segment: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("error replacing segment: %w", err)
+	}
+	return nil
+}
+
+// Evict drops the oldest unacknowledged records until the queue is within the retention
+// limits, returning how many records and metric points were dropped. Limits set to zero
+// are not enforced, the agent fills in its default age and size limits with retentionConfig.
+// The size is measured on the segment files.
+func (q *Queue) Evict(retention RetentionConfig, now time.Time) (int, int, error) {
+	excessRecords := 0
+	if retention.MaxRecords > 0 {
+		excessRecords = q.Len() - retention.MaxRecords
+	}
+	var excessBytes int64
+	if retention.MaxBytes > 0 {
+		size, err := q.Size()
+		if err != nil {
+			return 0, 0, err
+		}
+		if size > retention.MaxBytes {
+			// Acknowledged records stay on disk until their segment is removed.
+			acked, err := q.ackedBytes()
+			if err != nil {
+				return 0, 0, err
+			}
+			size -= acked
+		}
+		excessBytes = size - retention.MaxBytes
+	}
+	var cutoff time.Time
+	if retention.MaxAge > 0 {
+		cutoff = now.Add(-retention.MaxAge)
+	}
+	if excessRecords <= 0 && excessBytes <= 0 && cutoff.IsZero() {
+		return 0, 0, nil
+	}
+
+	var droppedRecords, droppedPoints int
+	var lastDropped uint64
+	previous := q.ackedSeq
+	for i, first := range q.segments {
+		if i+1 < len(q.segments) && q.segments[i+1]-1 <= q.ackedSeq {
+			continue
+		}
+		stopped, err := q.scanSegment(first, func(record QueueRecord, size int) bool {
+			if record.Seq <= q.ackedSeq {
+				return true
+			}
+			if excessRecords <= 0 && excessBytes <= 0 && !record.Time.Before(cutoff) {
+				return false
+			}
+			excessBytes -= int64(size)
+			// A compacted record stands for the collections since the previous record.
+			excessRecords -= int(record.Seq - previous)
+			previous = record.Seq
+			droppedRecords++
+			droppedPoints += len(record.Payload.Metrics)
+			lastDropped = record.Seq
+			return true
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+		if stopped {
+			break
+		}
+	}
+
+	if droppedRecords == 0 {
+		return 0, 0, nil
+	}
+	return droppedRecords, droppedPoints, q.Ack(lastDropped)
+}
+
+// Purge drops every pending record older than maxAge, also those queued after newer records,
+// e.g. imported with their original time, returning how many records and metric points were
+// dropped. The old records at the head of the queue are acknowledged, the others are removed
+// by rewriting their segments.
+func (q *Queue) Purge(maxAge time.Duration, now time.Time) (int, int, error) {
+	droppedRecords, droppedPoints, err := q.Evict(RetentionConfig{MaxAge: maxAge}, now)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	cutoff := now.Add(-maxAge)
+	_, err = q.Rewrite(func(records []QueueRecord) ([]QueueRecord, bool) {
+		var kept []QueueRecord
+		for _, record := range records {
+			if record.Time.Before(cutoff) {
+				droppedRecords++
+				droppedPoints += len(record.Payload.Metrics)
+				continue
+			}
+			kept = append(kept, record)
+		}
+		return kept, len(kept) < len(records)
+	})
+	return droppedRecords, droppedPoints, err
+}
+
+// Size returns the total size of the segment files in bytes.
+func (q *Queue) Size() (int64, error) {
+	var size int64
+	for _, first := range q.segments {
+		info, err := os.Stat(q.segmentPath(first))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return 0, fmt.Errorf("error reading segment: %w", err)
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+// ackedBytes returns the size of the acknowledged records still stored in the first segment.
+func (q *Queue) ackedBytes() (int64, error) {
+	if len(q.segments) == 0 || q.segments[0] > q.ackedSeq {
+		return 0, nil
+	}
+	var acked int64
+	_, err := q.scanSegment(q.segments[0], func(record QueueRecord, size int) bool {
+		if record.Seq > q.ackedSeq {
+			return false
+		}
+		acked += int64(size)
+		return true
+	})
+	return acked, err
+}
+
+// Len returns the number of unacknowledged collections, a compacted record counts for the
+// collections it replaced.
+func (q *Queue) Len() int {
+	return int(q.nextSeq - 1 - q.ackedSeq)
+}
+
+func (q *Queue) segmentPath(first uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", first, segmentExtension))
+}
+
+// encodeRecord frames a record as "<crc32c hex> <body>\n". The body is the JSON record, or
+// "<codecs>:<base64>" when it is compressed and/or encrypted, e.g. "aes256gcm+zstd:..." for a
+// record compressed with zstd and then encrypted with key.
+func encodeRecord(record QueueRecord, compression string, key []byte) ([]byte, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding record: %w", err)
+	}
+
+	var codecs []string
+	if compression != "" && compression != compressionNone {
+		if data, err = compressData(data, compression); err != nil {
+			return nil, err
+		}
+		codecs = append(codecs, compression)
+	}
+	if key != nil {
+		if data, err = encryptData(data, key); err != nil {
+			return nil, err
+		}
+		codecs = append([]string{encryptionCodec}, codecs...)
+	}
+	if len(codecs) > 0 {
+		data = append([]byte(strings.Join(codecs, "+")+":"), base64.StdEncoding.EncodeToString(data)...)
+	}
+
+	line := make([]byte, 0, len(data)+10)
+	line = append(line, fmt.Sprintf("%08x ", crc32.Checksum(data, crcTable))...)
+	line = append(line, data...)
+	return append(line, '\n'), nil
+}
+
+// decodeRecord decodes a record written with any compression, decrypting it with key.
+func decodeRecord(line []byte, key []byte) (QueueRecord, error) {
+	var record QueueRecord
+	data, err := decodeFrame(line)
+	if err != nil {
+		return record, err
+	}
+
+	if codecs, encoded, ok := bytes.Cut(data, []byte(":")); ok && data[0] != '{' {
+		if data, err = base64.StdEncoding.DecodeString(string(encoded)); err != nil {
+			return record, fmt.Errorf("error decoding record: %w", err)
+		}
+		for _, codec := range strings.Split(string(codecs), "+") {
+			if codec == encryptionCodec {
+				data, err = decryptData(data, key)
+			} else {
+				data, err = decompressData(data, codec)
+			}
+			if err != nil {
+				return record, err
+			}
+		}
+	}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return record, fmt.Errorf("error decoding record: %w", err)
+	}
+	return record, nil
+}
+
+// decodeFrame verifies the checksum of a framed record and returns its body.
+func decodeFrame(line []byte) ([]byte, error) {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	if len(line) < 10 || line[8] != ' ' {
+		return nil, fmt.Errorf("malformed record")
+	}
+	checksum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("malformed checksum: %w", err)
+	}
+	data := line[9:]
+	if crc32.Checksum(data, crcTable) != uint32(checksum) {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	return data, nil
+}
+
+func syncFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, storageFileMode)
+	if err != nil {
+		return fmt.Errorf("error opening segment: %w", err)
+	}
+	defer file.Close()
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("error syncing segment: %w", err)
+	}
+	return nil
+}
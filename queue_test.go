@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPayload(name string) Payload {
+	return Payload{Version: "test", Metrics: []Metric{{Metric: name, Value: 1, Timestamp: "2026-01-01T00:00:00Z"}}}
+}
+
+func appendPayloads(t *testing.T, dir string, options StorageConfig, names ...string) {
+	t.Helper()
+	q, err := openQueue(dir, options)
+	require.NoError(t, err)
+	defer q.Close()
+	for _, name := range names {
+		_, err := q.Append(testPayload(name))
+		require.NoError(t, err)
+	}
+}
+
+func pendingNames(t *testing.T, dir string, options StorageConfig) []string {
+	t.Helper()
+	q, err := openQueue(dir, options)
+	require.NoError(t, err)
+	defer q.Close()
+
+	records, err := q.Pending(0)
+	require.NoError(t, err)
+	var names []string
+	for _, record := range records {
+		names = append(names, record.Payload.Metrics[0].Metric)
+	}
+	return names
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+segmentExtension))
+	require.NoError(t, err)
+	return matches
+}
+
+func TestQueue_AppendPendingAck(t *testing.T) {
+	dir := t.TempDir()
+	options := StorageConfig{SegmentMaxBytes: 200}
+
+	appendPayloads(t, dir, options, "a", "b", "c", "d", "e")
+	assert.Greater(t, len(segmentFiles(t, dir)), 1, "small segments rotate")
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, pendingNames(t, dir, options))
+
+	q, err := openQueue(dir, options)
+	require.NoError(t, err)
+	assert.Equal(t, 5, q.Len())
+	batch, err := q.Pending(2)
+	require.NoError(t, err)
+	require.Len(t, batch, 2)
+	require.NoError(t, q.Ack(batch[1].Seq))
+	q.Close()
+
+	assert.Equal(t, []string{"c", "d", "e"}, pendingNames(t, dir, options))
+
+	q, err = openQueue(dir, options)
+	require.NoError(t, err)
+	require.NoError(t, q.Ack(5))
+	assert.Zero(t, q.Len())
+	q.Close()
+	assert.Empty(t, segmentFiles(t, dir))
+
+	appendPayloads(t, dir, options, "f")
+	q, err = openQueue(dir, options)
+	require.NoError(t, err)
+	records, err := q.Pending(0)
+	require.NoError(t, err)
+	q.Close()
+	require.Len(t, records, 1)
+	assert.Equal(t, uint64(6), records[0].Seq, "sequence numbers keep growing after segments are removed")
+}
+
+func TestQueue_RecoversTornTail(t *testing.T) {
+	dir := t.TempDir()
+	appendPayloads(t, dir, StorageConfig{}, "a", "b")
+
+	segments := segmentFiles(t, dir)
+	require.Len(t, segments, 1)
+	file, err := os.OpenFile(segments[0], os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = file.WriteString(`1234abcd {"seq":3,"payload":{"metr`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	appendPayloads(t, dir, StorageConfig{}, "c")
+
+	assert.Equal(t, []string{"a", "b", "c"}, pendingNames(t, dir, StorageConfig{}))
+	data, err := os.ReadFile(segments[0])
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "1234abcd", "torn tail is truncated before appending")
+}
+
+func TestQueue_SkipsCorruptRecords(t *testing.T) {
+	dir := t.TempDir()
+	options := StorageConfig{SegmentMaxBytes: 1}
+	appendPayloads(t, dir, options, "a", "b", "c")
+
+	segments := segmentFiles(t, dir)
+	require.Len(t, segments, 3)
+	data, err := os.ReadFile(segments[1])
+	require.NoError(t, err)
+	data[20] ^= 0xff
+	require.NoError(t, os.WriteFile(segments[1], data, 0o644))
+
+	assert.Equal(t, []string{"a", "c"}, pendingNames(t, dir, options))
+}
+
+func TestQueue_InvalidFsyncPolicy(t *testing.T) {
+	_, err := openQueue(t.TempDir(), StorageConfig{Fsync: "sometimes"})
+	require.Error(t, err)
+}
+
+func TestEncodeDecodeRecord(t *testing.T) {
+	t.Parallel()
+
+	line, err := encodeRecord(QueueRecord{Seq: 7, Payload: testPayload("cpu_used")}, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, byte('\n'), line[len(line)-1])
+
+	record, err := decodeRecord(line, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(7), record.Seq)
+	assert.Equal(t, "cpu_used", record.Payload.Metrics[0].Metric)
+
+	line[len(line)-3] = 'X'
+	_, err = decodeRecord(line, nil)
+	require.Error(t, err)
+}
+
+func TestEncodeDecodeRecord_Compressed(t *testing.T) {
+	t.Parallel()
+
+	for _, compression := range []string{compressionGzip, compressionZstd} {
+		line, err := encodeRecord(QueueRecord{Seq: 3, Payload: testPayload("cpu_used")}, compression, nil)
+		require.NoError(t, err)
+		assert.Contains(t, string(line), " "+compression+":")
+		assert.Equal(t, 1, bytes.Count(line, []byte("\n")))
+
+		record, err := decodeRecord(line, nil)
+		require.NoError(t, err, compression)
+		assert.Equal(t, uint64(3), record.Seq)
+		assert.Equal(t, "cpu_used", record.Payload.Metrics[0].Metric)
+	}
+}
+
+func TestQueue_MixedStorageCompression(t *testing.T) {
+	dir := t.TempDir()
+	appendPayloads(t, dir, StorageConfig{}, "a", "b")
+	appendPayloads(t, dir, StorageConfig{Compression: compressionZstd}, "c", "d")
+	appendPayloads(t, dir, StorageConfig{Compression: compressionGzip}, "e")
+
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, pendingNames(t, dir, StorageConfig{}))
+
+	_, err := openQueue(dir, StorageConfig{Compression: "lz4"})
+	require.Error(t, err)
+}
+
+func TestQueue_EvictByAgeBytesAndRecords(t *testing.T) {
+	dir := t.TempDir()
+	appendPayloads(t, dir, StorageConfig{}, "a", "b", "c", "d", "e")
+
+	q, err := openQueue(dir, StorageConfig{})
+	require.NoError(t, err)
+	defer q.Close()
+
+	records, points, err := q.Evict(RetentionConfig{MaxRecords: 4}, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 1, records)
+	assert.Equal(t, 1, points)
+	assert.Equal(t, 4, q.Len())
+
+	size, err := q.Size()
+	require.NoError(t, err)
+	records, _, err = q.Evict(RetentionConfig{MaxBytes: size - 1}, time.Now())
+	require.NoError(t, err)
+	assert.Zero(t, records, "acknowledged records don't count against the budget")
+
+	records, _, err = q.Evict(RetentionConfig{MaxBytes: size / 2}, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 2, records)
+
+	records, _, err = q.Evict(RetentionConfig{MaxAge: time.Hour}, time.Now())
+	require.NoError(t, err)
+	assert.Zero(t, records)
+
+	records, points, err = q.Evict(RetentionConfig{MaxAge: time.Hour}, time.Now().Add(2*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 2, records)
+	assert.Equal(t, 2, points)
+	assert.Zero(t, q.Len())
+}
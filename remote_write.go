@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	formatRemoteWrite = "prometheus_remote_write"
+
+	remoteWritePath    = "api/v1/write"
+	remoteWriteVersion = "0.1.0"
+)
+
+// seriesAttributes are the payload attributes identifying the series of the time series
+// formats. Other attributes, such as the uptime or the public IP, would create a new series
+// on each change.
+var seriesAttributes = []string{"hostname", "motherboard_id"}
+
+// remoteWriteBody encodes the payload as a snappy-compressed remote_write WriteRequest.
+func remoteWriteBody(payload Payload) []byte {
+	return snappy.Encode(nil, remoteWriteRequest(payload))
+}
+
+// remoteWriteRequest encodes the payload in the protobuf wire format of prometheus.WriteRequest.
+// Each series is named like on the /metrics endpoint and labelled with the identifying
+// attributes and the metric labels. Points of the same series become samples of one time series.
+func remoteWriteRequest(payload Payload) []byte {
+	type series struct {
+		labels  [][2]string
+		samples []byte
+	}
+	var keys []string
+	index := make(map[string]*series)
+	for _, m := range payload.Metrics {
+		labels := remoteWriteLabels(payload.Attributes, m)
+		key := fmt.Sprint(labels)
+		s, ok := index[key]
+		if !ok {
+			s = &series{labels: labels}
+			index[key] = s
+			keys = append(keys, key)
+		}
+
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(m.Value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(metricTime(m).UnixMilli()))
+		s.samples = appendMessage(s.samples, 2, sample)
+	}
+
+	var b []byte
+	for _, key := range keys {
+		s := index[key]
+		var ts []byte
+		for _, label := range s.labels {
+			var l []byte
+			l = appendString(l, 1, label[0])
+			l = appendString(l, 2, label[1])
+			ts = appendMessage(ts, 1, l)
+		}
+		ts = append(ts, s.samples...)
+		b = appendMessage(b, 1, ts)
+	}
+	return b
+}
+
+// remoteWriteLabels returns the labels of the metric's series sorted by name, as remote_write
+// requires. Metric labels take precedence over attributes of the same name.
+func remoteWriteLabels(attributes map[string]interface{}, m Metric) [][2]string {
+	values := map[string]string{"__name__": prometheusMetricName(m.Metric)}
+	for _, name := range seriesAttributes {
+		if value, ok := attributes[name]; ok {
+			values[name] = fmt.Sprint(value)
+		}
+	}
+	for name, value := range m.Labels {
+		values[prometheusLabelName(name)] = value
+	}
+
+	labels := make([][2]string, 0, len(values))
+	for name, value := range values {
+		if value != "" {
+			labels = append(labels, [2]string{name, value})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+	return labels
+}
+
+// prometheusLabelName replaces the characters not allowed in label names.
+func prometheusLabelName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r == '_':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// remoteWriteSeries is a decoded remote_write time series.
+type remoteWriteSeries struct {
+	labels map[string]string
+	names  []string // Label names in request order
+	values []float64
+	times  []int64
+}
+
+// decodeRemoteWrite decodes a snappy-compressed WriteRequest like a remote_write receiver does.
+func decodeRemoteWrite(t *testing.T, body []byte) []remoteWriteSeries {
+	t.Helper()
+	data, err := snappy.Decode(nil, body)
+	require.NoError(t, err)
+
+	var result []remoteWriteSeries
+	for _, ts := range protoMessages(t, data, 1) {
+		series := remoteWriteSeries{labels: make(map[string]string)}
+		for _, label := range protoMessages(t, ts, 1) {
+			fields := decodeProto(t, label)
+			require.Len(t, fields, 2)
+			series.labels[string(fields[0].bytes)] = string(fields[1].bytes)
+			series.names = append(series.names, string(fields[0].bytes))
+		}
+		for _, sample := range protoMessages(t, ts, 2) {
+			fields := decodeProto(t, sample)
+			require.Len(t, fields, 2)
+			series.values = append(series.values, math.Float64frombits(fields[0].value))
+			series.times = append(series.times, int64(fields[1].value))
+		}
+		result = append(result, series)
+	}
+	return result
+}
+
+func remoteWritePayload() Payload {
+	return Payload{
+		Version:    "1.2.3",
+		Attributes: map[string]interface{}{"hostname": "web-1", "motherboard_id": "mb-1", "uptime": 1234},
+		Metrics: []Metric{
+			{Metric: "disk_used", Value: 10, Timestamp: "2024-01-01T00:00:00Z", Labels: map[string]string{"mount-point": "/"}},
+			{Metric: "disk_used", Value: 20, Timestamp: "2024-01-01T00:00:00Z", Labels: map[string]string{"mount-point": "/data"}},
+			{Metric: "disk_used", Value: 11, Timestamp: "2024-01-01T00:01:00Z", Labels: map[string]string{"mount-point": "/"}},
+		},
+	}
+}
+
+func TestRemoteWriteRequest(t *testing.T) {
+	t.Parallel()
+
+	series := decodeRemoteWrite(t, remoteWriteBody(remoteWritePayload()))
+	require.Len(t, series, 2, "points of the same series are samples of one time series")
+
+	root := series[0]
+	assert.Equal(t, []string{"__name__", "hostname", "motherboard_id", "mount_point"}, root.names, "labels are sorted")
+	assert.Equal(t, map[string]string{
+		"__name__":       "uptinio_disk_used",
+		"hostname":       "web-1",
+		"motherboard_id": "mb-1",
+		"mount_point":    "/",
+	}, root.labels)
+	assert.Equal(t, []float64{10, 11}, root.values)
+	assert.Equal(t, []int64{1704067200000, 1704067260000}, root.times)
+	assert.Equal(t, "/data", series[1].labels["mount_point"])
+}
+
+func TestPrometheusLabelName(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "mount_point", prometheusLabelName("mount-point"))
+	assert.Equal(t, "_0core", prometheusLabelName("0core"))
+	assert.Equal(t, "status_code", prometheusLabelName("status_code"))
+}
+
+func TestDestination_RemoteWrite(t *testing.T) {
+	var series []remoteWriteSeries
+	status := http.StatusNoContent
+	configured := setupDestinations(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/write", r.URL.Path)
+		assert.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, protobufContentType, r.Header.Get("Content-Type"))
+		assert.Equal(t, remoteWriteVersion, r.Header.Get("X-Prometheus-Remote-Write-Version"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		series = append(series, decodeRemoteWrite(t, body)...)
+		w.WriteHeader(status)
+	})
+	configured[0].Format = formatRemoteWrite
+	configured[0].Path = defaultPath(formatRemoteWrite)
+	config.Compression = compressionGzip
+
+	require.NoError(t, configured[0].saveMetrics(remoteWritePayload()))
+	require.NoError(t, configured[0].sendQueuedMetrics(), "receivers answer 204")
+	assert.Len(t, series, 2)
+
+	status = http.StatusBadRequest
+	require.NoError(t, configured[0].saveMetrics(testPayload("out_of_order")))
+	require.NoError(t, configured[0].sendQueuedMetrics(), "rejected samples are quarantined")
+	rejected, err := pendingRecords(configured[0], true)
+	require.NoError(t, err)
+	assert.Len(t, rejected, 1)
+}
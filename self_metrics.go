@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+var (
+	agentMetrics  = NewSelfMetrics()
+	latestMetrics = &LatestMetrics{}
+)
+
+// NewSelfMetrics creates an empty set of self-metrics.
+func NewSelfMetrics() *SelfMetrics {
+	return &SelfMetrics{values: make(map[string]float64), labeled: make(map[string]LabeledSelfMetric)}
+}
+
+// Add increments the named self-metric by delta.
+func (s *SelfMetrics) Add(name string, delta float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[name] += delta
+}
+
+// Set replaces the value of the named self-metric.
+func (s *SelfMetrics) Set(name string, value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[name] = value
+}
+
+// SetLabeled replaces the value of the named self-metric with the given labels. Without
+// labels it is the same as Set.
+func (s *SelfMetrics) SetLabeled(name string, labels map[string]string, value float64) {
+	if len(labels) == 0 {
+		s.Set(name, value)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.labeled[name+prometheusLabels(labels)] = LabeledSelfMetric{name: name, labels: labels, value: value}
+}
+
+// GetLabeled returns the current value of the named self-metric with the given labels.
+func (s *SelfMetrics) GetLabeled(name string, labels map[string]string) float64 {
+	if len(labels) == 0 {
+		return s.Get(name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.labeled[name+prometheusLabels(labels)].value
+}
+
+// Get returns the current value of the named self-metric.
+func (s *SelfMetrics) Get(name string) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[name]
+}
+
+// Snapshot returns the self-metrics sorted by name.
+func (s *SelfMetrics) Snapshot() []Metric {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	metrics := make([]Metric, 0, len(s.values)+len(s.labeled))
+	for name, value := range s.values {
+		metrics = append(metrics, Metric{Metric: name, Value: value, Timestamp: now})
+	}
+	for _, m := range s.labeled {
+		metrics = append(metrics, Metric{Metric: m.name, Value: m.value, Timestamp: now, Labels: m.labels})
+	}
+	sort.SliceStable(metrics, func(i, j int) bool {
+		if metrics[i].Metric != metrics[j].Metric {
+			return metrics[i].Metric < metrics[j].Metric
+		}
+		return prometheusLabels(metrics[i].Labels) < prometheusLabels(metrics[j].Labels)
+	})
+	return metrics
+}
+
+// Store replaces the latest collected metrics.
+func (l *LatestMetrics) Store(metrics []Metric) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.metrics = append([]Metric(nil), metrics...)
+}
+
+// Load returns a copy of the latest collected metrics.
+func (l *LatestMetrics) Load() []Metric {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append([]Metric(nil), l.metrics...)
+}
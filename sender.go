@@ -3,18 +3,26 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"path"
-	"strings"
 	"time"
 )
 
-const HOST_PATH = "api/v1/server_metrics"
+const (
+	HOST_PATH                  = "api/v1/server_metrics"
+	defaultSendBatchMaxRecords = 60
+	defaultMaxPayloadBytes     = 1024 * 1024
+	defaultMaxPayloadMetrics   = 1000
+)
 
-var metricsHTTPClient = &http.Client{Timeout: 10 * time.Second}
+var (
+	metricsHTTPClient = &http.Client{Timeout: ingestTimeout}
+	senderState       = &SenderState{}
+)
 
 func buildURL(schema, host, hostPath string) (string, error) {
 	u := &url.URL{
@@ -25,11 +33,218 @@ func buildURL(schema, host, hostPath string) (string, error) {
 	return u.String(), nil
 }
 
-func sendMetrics(payload Payload) error {
-	return sendMetricsAttempt(payload, false)
+// sendQueuedMetrics sends the queued records oldest-first in bounded batches, splitting each
+// batch into size-bounded requests and acknowledging the records the server accepted.
+// It stops at the first failure, leaving the unsent records in the queue.
+// Records the server rejects as invalid are moved to the rejected queue.
+func (d *Destination) sendQueuedMetrics() error {
+	d.sending.Lock()
+	defer d.sending.Unlock()
+
+	maxRecords := config.SendBatchMaxRecords
+	if maxRecords <= 0 {
+		maxRecords = defaultSendBatchMaxRecords
+	}
+
+	// With the breaker open a single record probes the server before the backlog is sent.
+	probing := d.state.breaker != breakerClosed
+	if probing {
+		d.state.setBreaker(breakerHalfOpen)
+		log.Println("Circuit breaker half-open; probing the server with one record")
+	}
+
+	sent := 0
+	for {
+		limit := maxRecords
+		if probing {
+			limit = 1
+		}
+		batch, err := d.loadMetricsBatch(limit)
+		if err != nil {
+			return fmt.Errorf("error loading metrics from queue: %w", err)
+		}
+		if batch.LastSeq == 0 {
+			break
+		}
+
+		n, err := d.sendBatchInChunks(batch)
+		sent += n
+		if err != nil {
+			return err
+		}
+
+		if err := d.ackMetricsBatch(batch); err != nil {
+			return fmt.Errorf("error acknowledging metrics: %w", err)
+		}
+		log.Printf("Acknowledged records %d-%d", batch.FirstSeq, batch.LastSeq)
+		if probing {
+			probing = false
+			d.state.setBreaker(breakerClosed)
+			log.Println("Probe succeeded; circuit breaker closed")
+		}
+	}
+
+	if sent == 0 {
+		log.Println("No metrics available to send")
+	} else {
+		log.Printf("Metrics succesfully sent: %d", sent)
+	}
+
+	// Let a limit shrunk by a 413 grow back once the whole backlog went through.
+	d.state.chunkMetrics = min(d.state.chunkMetrics*2, maxPayloadMetrics())
+	return nil
+}
+
+// sendBatchInChunks sends the batch in chunks bounded by max_payload_bytes and the current
+// metric limit, halving the limit whenever the server answers 413. A chunk the server
+// rejects as invalid is halved until the rejected metrics are isolated and quarantined, unless
+// single metrics keep being rejected in a row.
+// Records are acknowledged as soon as all their metrics are sent or quarantined.
+// It returns the number of metrics sent.
+func (d *Destination) sendBatchInChunks(batch MetricsBatch) (int, error) {
+	maxMetrics := maxPayloadMetrics()
+	maxBytes := config.MaxPayloadBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxPayloadBytes
+	}
+	if d.state.chunkMetrics <= 0 || d.state.chunkMetrics > maxMetrics {
+		d.state.chunkMetrics = maxMetrics
+	}
+
+	sizes, overhead, err := metricSizes(batch)
+	if err != nil {
+		return 0, err
+	}
+
+	sent, done := 0, 0
+	bisect := 0     // Metric limit while isolating rejected metrics
+	rejections := 0 // Single metrics rejected in a row
+	metrics := batch.Payload.Metrics
+	for done < len(metrics) {
+		end := chunkEnd(sizes, overhead, done, d.state.chunkMetrics, maxBytes)
+		if retryEnd := batch.retryEnd(done, d.state.retry); retryEnd > 0 {
+			end = retryEnd
+		}
+		if bisect > 0 && end-done > bisect {
+			end = done + bisect
+		}
+		chunk := Payload{
+			Version:    batch.Payload.Version,
+			Attributes: batch.Payload.Attributes,
+			Metrics:    metrics[done:end],
+			BatchID:    batch.chunkKey(done, end),
+			Records:    batch.recordRefs(done, end),
+		}
+
+		agentMetrics.Add("agent_send_attempts_total", 1)
+		err := d.deliver(chunk)
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusRequestEntityTooLarge && end-done > 1 {
+			d.state.chunkMetrics = (end - done) / 2
+			d.state.retry = nil
+			log.Printf("Payload too large (%d metrics); retrying with chunks of %d metrics", end-done, d.state.chunkMetrics)
+			continue
+		}
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnsupportedMediaType && d.requestCompression() != "" {
+			d.state.uncompressedBodies = true
+			log.Printf("Server rejected %s request bodies; sending uncompressed", config.Compression)
+			continue
+		}
+
+		switch classifySendError(err) {
+		case sendRejected:
+			d.state.retry = nil
+			if end-done > 1 {
+				bisect = (end - done) / 2
+				log.Printf("Server rejected %d metrics (%v); retrying in chunks of %d to isolate them", end-done, err, bisect)
+				continue
+			}
+			rejections++
+			if rejections >= maxConsecutiveRejections {
+				agentMetrics.Add("agent_send_failures_total", 1)
+				return sent, fmt.Errorf("server rejected %d metrics in a row, keeping the rest queued: %w", rejections, err)
+			}
+			if err := d.quarantineRejected(chunk, err); err != nil {
+				return sent, err
+			}
+			bisect = 0
+		case sendTransient, sendUnauthorized, sendMisconfigured:
+			if classifySendError(err) == sendUnauthorized {
+				d.tokens.Invalidate()
+			}
+			// The server may have ingested the request, the retry reuses its metrics and key.
+			d.state.retry = batch.metricRange(done, end)
+			agentMetrics.Add("agent_send_failures_total", 1)
+			return sent, err
+		default:
+			d.state.retry = nil
+			bisect, rejections = 0, 0
+			sent += end - done
+			agentMetrics.Add("agent_metrics_sent_total", float64(end-done))
+			agentMetrics.SetLabeled("agent_last_send_timestamp_seconds", d.state.labels, float64(time.Now().Unix()))
+		}
+
+		done = end
+		if end < len(metrics) {
+			if err := d.ackMetricsRecords(batch.sentThroughSeq(done)); err != nil {
+				return sent, fmt.Errorf("error acknowledging metrics: %w", err)
+			}
+		}
+	}
+	return sent, nil
+}
+
+func maxPayloadMetrics() int {
+	if config.MaxPayloadMetrics <= 0 {
+		return defaultMaxPayloadMetrics
+	}
+	return config.MaxPayloadMetrics
+}
+
+// metricSizes returns the encoded size of each metric and of the payload without metrics.
+// The first metric of each record also accounts for its record reference, and the overhead
+// for the batch ID and the reference of a record the request starts in the middle of.
+func metricSizes(batch MetricsBatch) ([]int, int, error) {
+	empty := batch.Payload
+	empty.Metrics = []Metric{}
+	empty.BatchID = formatUUID([16]byte{})
+	empty.Records = []RecordRef{{ID: newUUID(), Seq: batch.LastSeq}}
+	data, err := json.Marshal(empty)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error marshaling payload: %w", err)
+	}
+
+	sizes := make([]int, len(batch.Payload.Metrics))
+	for i, metric := range batch.Payload.Metrics {
+		data, err := json.Marshal(metric)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error marshaling metric: %w", err)
+		}
+		sizes[i] = len(data) + 1 // separating comma
+		if i < len(batch.Offsets) && batch.Offsets[i] == 0 {
+			ref, err := json.Marshal(RecordRef{ID: batch.IDs[batch.Seqs[i]], Seq: batch.Seqs[i]})
+			if err != nil {
+				return nil, 0, fmt.Errorf("error marshaling record reference: %w", err)
+			}
+			sizes[i] += len(ref) + 1
+		}
+	}
+	return sizes, len(data), nil
+}
+
+// chunkEnd returns the end of the chunk starting at start that fits both limits.
+// A chunk always holds at least one metric.
+func chunkEnd(sizes []int, overhead, start, maxMetrics, maxBytes int) int {
+	end := start + 1
+	size := overhead + sizes[start]
+	for end < len(sizes) && end-start < maxMetrics && size+sizes[end] <= maxBytes {
+		size += sizes[end]
+		end++
+	}
+	return end
 }
 
-func sendMetricsAttempt(payload Payload, retried bool) error {
+func (d *Destination) sendMetrics(payload Payload) error {
 	if _, ok := payload.Attributes["motherboard_id"]; !ok {
 		log.Printf("WARNING: motherboard_id not found in attributes")
 	} else {
@@ -40,32 +255,56 @@ func sendMetricsAttempt(payload Payload, retried bool) error {
 		log.Printf("WARNING: mac_address still present in attributes")
 	}
 
-	data, err := json.Marshal(payload)
+	data, contentType, err := d.encodePayload(payload)
 	if err != nil {
-		return fmt.Errorf("error marshaling payload: %w", err)
+		return err
 	}
-	fullURL, err := buildURL(config.Schema, config.Host, HOST_PATH)
+	fullURL, err := d.requestURL()
 	if err != nil {
 		return fmt.Errorf("error building URL: %v", err)
 	}
 
-	authToken := strings.TrimSpace(config.AuthToken)
+	authToken, err := d.authToken()
+	if err != nil {
+		return err
+	}
 	if authToken == "" {
 		return fmt.Errorf("authentication token not configured")
 	}
 
-	log.Printf("DEBUG: Schema=%q, Host=%q", config.Schema, config.Host)
-	log.Printf("DEBUG: AuthToken length=%d (first 5 characters: %s...)",
-		len(authToken), authToken[:min(5, len(authToken))])
+	log.Printf("DEBUG: Schema=%q, Host=%q", d.Schema, d.Host)
+	log.Printf("DEBUG: AuthToken length=%d (%s)", len(authToken), redacted)
 	log.Printf("DEBUG: POST URL: %q", fullURL)
 	log.Printf("DEBUG: Payload size: %d bytes, metrics count: %d", len(data), len(payload.Metrics))
 
+	encoding := d.requestCompression()
+	if encoding != "" {
+		if data, err = compressData(data, encoding); err != nil {
+			return err
+		}
+	}
+	agentMetrics.Add("agent_request_bytes_total", float64(len(data)))
+
 	req, err := http.NewRequest("POST", fullURL, bytes.NewBuffer(data))
 	if err != nil {
 		return fmt.Errorf("error creating request: %w", err)
 	}
-	req.Header.Set("Authorization", authToken)
-	req.Header.Set("Content-Type", "application/json")
+	secret, err := signingSecret(config.Signing)
+	if err != nil {
+		return err
+	}
+	if secret != nil {
+		signRequest(req, data, secret, time.Now())
+	}
+	req.Header.Set("Authorization", d.authorization(authToken))
+	req.Header.Set("Content-Type", contentType)
+	if payload.BatchID != "" {
+		req.Header.Set("Idempotency-Key", payload.BatchID)
+	}
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	d.setFormatHeaders(req.Header)
 
 	resp, err := metricsHTTPClient.Do(req)
 	if err != nil {
@@ -73,18 +312,33 @@ func sendMetricsAttempt(payload Payload, retried bool) error {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusRequestEntityTooLarge && !retried && len(payload.Metrics) > 6 {
-		log.Printf("Payload too large (%d bytes); retrying with latest metrics only", len(data))
-		payload.Metrics = payload.Metrics[len(payload.Metrics)-6:]
-		return sendMetricsAttempt(payload, true)
+	if resp.StatusCode == http.StatusConflict {
+		log.Printf("Request %s was already ingested by the server", payload.BatchID)
+		return nil
 	}
-
-	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	if !d.delivered(resp.StatusCode) {
+		statusErr := &StatusError{StatusCode: resp.StatusCode}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			statusErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		return statusErr
 	}
 	return nil
 }
 
+// requestCompression returns the configured request body encoding, or "" when bodies are
+// sent uncompressed. remote_write bodies are always snappy-compressed instead.
+func (d *Destination) requestCompression() string {
+	if config.Compression == compressionNone || d.state.uncompressedBodies || d.Format == formatRemoteWrite {
+		return ""
+	}
+	return config.Compression
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
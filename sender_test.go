@@ -1,9 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -39,7 +42,7 @@ func TestSendMetrics_Success(t *testing.T) {
 		metricsHTTPClient = origClient
 	})
 
-	err := sendMetrics(Payload{
+	err := defaultDestination().sendMetrics(Payload{
 		Version:    "test",
 		Attributes: map[string]interface{}{"motherboard_id": "board-1"},
 		Metrics:    []Metric{{Metric: "cpu_used", Value: 100, Timestamp: "2026-01-01T00:00:00Z"}},
@@ -47,46 +50,183 @@ func TestSendMetrics_Success(t *testing.T) {
 	require.NoError(t, err)
 }
 
-func TestSendMetrics_RetriesOn413WithLatestMetrics(t *testing.T) {
-	requestCount := 0
+func TestSendMetrics_CompressesBody(t *testing.T) {
+	for _, compression := range []string{compressionGzip, compressionZstd} {
+		sentBytes := agentMetrics.Get("agent_request_bytes_total")
+		var received int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, compression, r.Header.Get("Content-Encoding"))
+			body, _ := io.ReadAll(r.Body)
+			received = len(body)
+			data, err := decompressData(body, compression)
+			require.NoError(t, err)
+			var payload Payload
+			require.NoError(t, json.Unmarshal(data, &payload))
+			assert.Equal(t, "cpu_used", payload.Metrics[0].Metric)
+			w.WriteHeader(http.StatusCreated)
+		}))
+
+		origConfig := config
+		origClient := metricsHTTPClient
+		config = Config{Schema: "http", Host: strings.TrimPrefix(server.URL, "http://"), AuthToken: "token", Compression: compression}
+		metricsHTTPClient = server.Client()
+
+		err := defaultDestination().sendMetrics(Payload{Version: "test", Metrics: []Metric{{Metric: "cpu_used", Value: 1, Timestamp: "2026-01-01T00:00:00Z"}}})
+		config = origConfig
+		metricsHTTPClient = origClient
+		server.Close()
+		require.NoError(t, err, compression)
+		assert.Equal(t, sentBytes+float64(received), agentMetrics.Get("agent_request_bytes_total"), "counts the compressed body")
+	}
+}
+
+func TestSendQueuedMetrics_FallsBackToUncompressedOn415(t *testing.T) {
+	var encodings []string
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		requestCount++
-		if requestCount == 1 {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		if r.Header.Get("Content-Encoding") != "" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(server.Close)
+
+	origConfig := config
+	origClient := metricsHTTPClient
+	origState := senderState
+	config = Config{
+		MetricsPath: filepath.Join(t.TempDir(), "metrics.json"),
+		Schema:      "http",
+		Host:        strings.TrimPrefix(server.URL, "http://"),
+		AuthToken:   "token",
+		Compression: compressionZstd,
+	}
+	metricsHTTPClient = server.Client()
+	senderState = &SenderState{}
+	t.Cleanup(func() {
+		config = origConfig
+		metricsHTTPClient = origClient
+		senderState = origState
+	})
+
+	require.NoError(t, saveMetricsToFile(testPayload("cpu_used")))
+	require.NoError(t, defaultDestination().sendQueuedMetrics())
+	require.NoError(t, saveMetricsToFile(testPayload("cpu_used")))
+	require.NoError(t, defaultDestination().sendQueuedMetrics())
+	assert.Equal(t, []string{compressionZstd, "", ""}, encodings, "uncompressed bodies are kept after a 415")
+}
+
+func TestSendQueuedMetrics_ShrinksChunksOn413(t *testing.T) {
+	var received []Metric
+	tooLarge := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload Payload
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		if len(payload.Metrics) > 3 {
+			tooLarge++
 			w.WriteHeader(http.StatusRequestEntityTooLarge)
 			return
 		}
-		body, _ := io.ReadAll(r.Body)
-		assert.NotContains(t, string(body), `"metric":"old"`)
-		assert.Contains(t, string(body), `"metric":"new"`)
+		received = append(received, payload.Metrics...)
 		w.WriteHeader(http.StatusCreated)
 	}))
 	t.Cleanup(server.Close)
 
 	origConfig := config
 	origClient := metricsHTTPClient
-	config = Config{Schema: "http", Host: strings.TrimPrefix(server.URL, "http://"), AuthToken: "token"}
+	origState := senderState
+	config = Config{
+		MetricsPath: filepath.Join(t.TempDir(), "metrics.json"),
+		Schema:      "http",
+		Host:        strings.TrimPrefix(server.URL, "http://"),
+		AuthToken:   "token",
+	}
 	metricsHTTPClient = server.Client()
+	senderState = &SenderState{}
 	t.Cleanup(func() {
 		config = origConfig
 		metricsHTTPClient = origClient
+		senderState = origState
 	})
 
 	metrics := make([]Metric, 10)
 	for i := range metrics {
-		name := "old"
-		if i >= len(metrics)-6 {
-			name = "new"
-		}
-		metrics[i] = Metric{Metric: name, Value: float64(i), Timestamp: "2026-01-01T00:00:00Z"}
+		metrics[i] = Metric{Metric: fmt.Sprintf("m%d", i), Value: float64(i), Timestamp: "2026-01-01T00:00:00Z"}
 	}
+	require.NoError(t, saveMetricsToFile(Payload{Version: "test", Metrics: metrics[:6]}))
+	require.NoError(t, saveMetricsToFile(Payload{Version: "test", Metrics: metrics[6:]}))
 
-	err := sendMetrics(Payload{
-		Version:    "test",
-		Attributes: map[string]interface{}{"motherboard_id": "board-1"},
-		Metrics:    metrics,
+	require.NoError(t, defaultDestination().sendQueuedMetrics())
+	assert.Equal(t, metrics, received, "every metric is delivered oldest-first")
+	assert.Equal(t, 2, tooLarge)
+
+	batch, err := defaultDestination().loadMetricsBatch(0)
+	require.NoError(t, err)
+	assert.Zero(t, batch.LastSeq)
+}
+
+func TestSendQueuedMetrics_ChunksByBytesAndAcknowledgesCompletedRecords(t *testing.T) {
+	requestCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		body, _ := io.ReadAll(r.Body)
+		assert.LessOrEqual(t, len(body), 400)
+		if requestCount == 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(server.Close)
+
+	origConfig := config
+	origClient := metricsHTTPClient
+	origState := senderState
+	config = Config{
+		MetricsPath:     filepath.Join(t.TempDir(), "metrics.json"),
+		Schema:          "http",
+		Host:            strings.TrimPrefix(server.URL, "http://"),
+		AuthToken:       "token",
+		MaxPayloadBytes: 400,
+	}
+	metricsHTTPClient = server.Client()
+	senderState = &SenderState{}
+	t.Cleanup(func() {
+		config = origConfig
+		metricsHTTPClient = origClient
+		senderState = origState
 	})
+
+	record := func(prefix string) Payload {
+		var metrics []Metric
+		for i := 0; i < 4; i++ {
+			metrics = append(metrics, Metric{Metric: fmt.Sprintf("%s_%d", prefix, i), Timestamp: "2026-01-01T00:00:00Z"})
+		}
+		return Payload{Version: "test", Attributes: map[string]interface{}{"motherboard_id": "board-1"}, Metrics: metrics}
+	}
+	require.NoError(t, saveMetricsToFile(record("first")))
+	require.NoError(t, saveMetricsToFile(record("second")))
+
+	err := defaultDestination().sendQueuedMetrics()
+	require.Error(t, err)
+	assert.Equal(t, 3, requestCount)
+
+	batch, err := defaultDestination().loadMetricsBatch(0)
 	require.NoError(t, err)
-	assert.Equal(t, 2, requestCount)
+	require.NotEmpty(t, batch.Payload.Metrics)
+	assert.Equal(t, "second_0", batch.Payload.Metrics[0].Metric, "the fully sent first record is acknowledged")
+	assert.Len(t, batch.Payload.Metrics, 4, "the partially sent record is kept whole")
+}
+
+func TestChunkEnd(t *testing.T) {
+	t.Parallel()
+
+	sizes := []int{10, 10, 10, 50, 10}
+	assert.Equal(t, 3, chunkEnd(sizes, 5, 0, 10, 40))
+	assert.Equal(t, 2, chunkEnd(sizes, 5, 0, 2, 1000))
+	assert.Equal(t, 4, chunkEnd(sizes, 5, 3, 10, 20), "an oversized metric is sent alone")
+	assert.Equal(t, 5, chunkEnd(sizes, 5, 4, 10, 1000))
 }
 
 func TestSendMetrics_413StillFailsWhenPayloadSmall(t *testing.T) {
@@ -104,7 +244,7 @@ func TestSendMetrics_413StillFailsWhenPayloadSmall(t *testing.T) {
 		metricsHTTPClient = origClient
 	})
 
-	err := sendMetrics(Payload{
+	err := defaultDestination().sendMetrics(Payload{
 		Version:    "test",
 		Attributes: map[string]interface{}{"motherboard_id": "board-1"},
 		Metrics:    []Metric{{Metric: "cpu_used", Value: 1, Timestamp: "2026-01-01T00:00:00Z"}},
@@ -118,7 +258,91 @@ func TestSendMetrics_MissingAuthToken(t *testing.T) {
 	config = Config{Schema: "http", Host: "example.com", AuthToken: "   "}
 	t.Cleanup(func() { config = origConfig })
 
-	err := sendMetrics(Payload{Attributes: map[string]interface{}{"motherboard_id": "x"}})
+	err := defaultDestination().sendMetrics(Payload{Attributes: map[string]interface{}{"motherboard_id": "x"}})
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "authentication token not configured")
 }
+
+func TestSendQueuedMetrics_SendsBoundedBatchesOldestFirst(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(server.Close)
+
+	origConfig := config
+	origClient := metricsHTTPClient
+	config = Config{
+		MetricsPath:         filepath.Join(t.TempDir(), "metrics.json"),
+		Schema:              "http",
+		Host:                strings.TrimPrefix(server.URL, "http://"),
+		AuthToken:           "token",
+		SendBatchMaxRecords: 2,
+	}
+	metricsHTTPClient = server.Client()
+	t.Cleanup(func() {
+		config = origConfig
+		metricsHTTPClient = origClient
+	})
+
+	for _, name := range []string{"m1", "m2", "m3", "m4", "m5"} {
+		require.NoError(t, saveMetricsToFile(Payload{Version: "test", Metrics: []Metric{{Metric: name, Timestamp: "2026-01-01T00:00:00Z"}}}))
+	}
+
+	require.NoError(t, defaultDestination().sendQueuedMetrics())
+	require.Len(t, bodies, 3)
+	assert.Contains(t, bodies[0], `"metric":"m1"`)
+	assert.Contains(t, bodies[0], `"metric":"m2"`)
+	assert.NotContains(t, bodies[0], `"metric":"m3"`)
+	assert.Contains(t, bodies[2], `"metric":"m5"`)
+
+	batch, err := defaultDestination().loadMetricsBatch(0)
+	require.NoError(t, err)
+	assert.Zero(t, batch.LastSeq)
+}
+
+func TestSendQueuedMetrics_AcknowledgesOnlyAcceptedRecords(t *testing.T) {
+	requestCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		if requestCount == 1 {
+			// Metrics collected while a send is in flight must survive the acknowledgement.
+			require.NoError(t, saveMetricsToFile(Payload{Version: "test", Metrics: []Metric{{Metric: "during_send"}}}))
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(server.Close)
+
+	origConfig := config
+	origClient := metricsHTTPClient
+	config = Config{
+		MetricsPath:         filepath.Join(t.TempDir(), "metrics.json"),
+		Schema:              "http",
+		Host:                strings.TrimPrefix(server.URL, "http://"),
+		AuthToken:           "token",
+		SendBatchMaxRecords: 1,
+	}
+	metricsHTTPClient = server.Client()
+	t.Cleanup(func() {
+		config = origConfig
+		metricsHTTPClient = origClient
+	})
+
+	require.NoError(t, saveMetricsToFile(Payload{Version: "test", Metrics: []Metric{{Metric: "sent"}}}))
+	require.NoError(t, saveMetricsToFile(Payload{Version: "test", Metrics: []Metric{{Metric: "rejected"}}}))
+
+	err := defaultDestination().sendQueuedMetrics()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "500")
+	assert.Equal(t, 2, requestCount)
+
+	batch, err := defaultDestination().loadMetricsBatch(0)
+	require.NoError(t, err)
+	require.Len(t, batch.Payload.Metrics, 2)
+	assert.Equal(t, "rejected", batch.Payload.Metrics[0].Metric)
+	assert.Equal(t, "during_send", batch.Payload.Metrics[1].Metric)
+}
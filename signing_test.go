@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signedRequest(t *testing.T, body string, secret []byte, now time.Time) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/metrics", bytes.NewBufferString(body))
+	signRequest(req, []byte(body), secret, now)
+	return req
+}
+
+func TestVerifyRequestSignature(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("shared-secret")
+	now := time.Unix(1700000000, 0)
+
+	req := signedRequest(t, `{"version":1}`, secret, now)
+	require.NoError(t, verifyRequestSignature(req, secret, time.Minute, now.Add(30*time.Second)))
+	var body map[string]int
+	require.NoError(t, json.NewDecoder(req.Body).Decode(&body), "the body can still be read")
+	assert.Equal(t, 1, body["version"])
+
+	req = signedRequest(t, `{"version":1}`, secret, now)
+	assert.ErrorContains(t, verifyRequestSignature(req, []byte("other"), time.Minute, now), "mismatch")
+
+	req = signedRequest(t, `{"version":1}`, secret, now)
+	req.Body = http.NoBody
+	assert.ErrorContains(t, verifyRequestSignature(req, secret, time.Minute, now), "mismatch", "tampered body")
+
+	req = signedRequest(t, `{"version":1}`, secret, now)
+	req.URL.Path = "/api/v1/other"
+	assert.ErrorContains(t, verifyRequestSignature(req, secret, time.Minute, now), "mismatch", "different path")
+
+	req = signedRequest(t, `{"version":1}`, secret, now)
+	assert.ErrorContains(t, verifyRequestSignature(req, secret, time.Minute, now.Add(2*time.Minute)), "away from", "replayed later")
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/metrics", nil)
+	assert.Error(t, verifyRequestSignature(req, secret, time.Minute, now), "unsigned")
+}
+
+func TestSigningSecret(t *testing.T) {
+	t.Parallel()
+
+	secret, err := signingSecret(SigningConfig{})
+	require.NoError(t, err)
+	assert.Nil(t, secret)
+
+	path := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(path, []byte("from-file\n"), 0600))
+	secret, err = signingSecret(SigningConfig{Secret: "inline", SecretFile: path})
+	require.NoError(t, err)
+	assert.Equal(t, "from-file", string(secret))
+
+	_, err = signingSecret(SigningConfig{SecretFile: filepath.Join(t.TempDir(), "missing")})
+	assert.Error(t, err)
+}
+
+func TestSendMetrics_SignsCompressedBody(t *testing.T) {
+	secret := []byte("shared-secret")
+	var verifyErr error
+	requests := 0
+	setupIdempotencyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if verifyErr = verifyRequestSignature(r, secret, time.Minute, time.Now()); verifyErr != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	config.Compression = compressionGzip
+	config.Signing = SigningConfig{Secret: string(secret)}
+
+	require.NoError(t, defaultDestination().sendMetrics(testPayload("a")))
+	require.NoError(t, verifyErr)
+
+	config.Signing = SigningConfig{}
+	require.Error(t, defaultDestination().sendMetrics(testPayload("b")))
+	assert.Error(t, verifyErr, "unsigned requests are rejected")
+	assert.Equal(t, 2, requests)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	formatFile   = "file"
+	formatStdout = "stdout"
+
+	spoolFilePrefix      = "metrics-"
+	spoolFileExt         = ".ndjson"
+	spoolPartialSuffix   = ".partial"
+	spoolTimeLayout      = "20060102T150405.000Z"
+	defaultSpoolMaxBytes = 16 * 1024 * 1024
+	defaultSpoolMaxAge   = time.Hour
+)
+
+var (
+	// Writer of the stdout sink, replaced in tests.
+	stdoutSink   io.Writer = os.Stdout
+	stdoutSinkMu sync.Mutex
+)
+
+// writeStdout prints the payload as a single JSON line.
+func writeStdout(payload Payload) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error marshaling payload: %w", err)
+	}
+	stdoutSinkMu.Lock()
+	defer stdoutSinkMu.Unlock()
+	if _, err := stdoutSink.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing to stdout: %w", err)
+	}
+	return nil
+}
+
+// writeSpool appends the payload as a JSON line to the file being filled in the spool
+// directory, e.g. metrics-20240101T000000.000Z.ndjson.partial. The file is renamed without
+// the .partial suffix once it reaches the size or age limit, so complete files can be
+// carried away while the agent is running.
+func (d *Destination) writeSpool(payload Payload, now time.Time) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error marshaling payload: %w", err)
+	}
+	data = append(data, '\n')
+
+	if err := os.MkdirAll(d.SpoolDir, storageDirMode); err != nil {
+		return fmt.Errorf("error creating spool directory: %w", err)
+	}
+	path, err := d.spoolFile(int64(len(data)), now)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, storageFileMode)
+	if err != nil {
+		return fmt.Errorf("error opening spool file: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("error writing spool file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("error syncing spool file: %w", err)
+	}
+	return nil
+}
+
+// spoolFile returns the partial file the next size bytes go to, completing the current
+// one first when it would exceed the size limit or is older than the age limit.
+func (d *Destination) spoolFile(size int64, now time.Time) (string, error) {
+	maxBytes := d.SpoolMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultSpoolMaxBytes
+	}
+	maxAge := d.SpoolMaxAge
+	if maxAge <= 0 {
+		maxAge = defaultSpoolMaxAge
+	}
+
+	partial, err := filepath.Glob(filepath.Join(d.SpoolDir, spoolFilePrefix+"*"+spoolFileExt+spoolPartialSuffix))
+	if err != nil {
+		return "", fmt.Errorf("error listing spool directory: %w", err)
+	}
+	sort.Strings(partial)
+	for i, path := range partial {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", fmt.Errorf("error reading spool file: %w", err)
+		}
+		created, err := time.Parse(spoolTimeLayout, strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), spoolFilePrefix), spoolFileExt+spoolPartialSuffix))
+		full := info.Size() > 0 && info.Size()+size > maxBytes
+		if i == len(partial)-1 && err == nil && !full && now.Sub(created) < maxAge {
+			return path, nil
+		}
+		if err := os.Rename(path, strings.TrimSuffix(path, spoolPartialSuffix)); err != nil {
+			return "", fmt.Errorf("error completing spool file: %w", err)
+		}
+	}
+
+	path := filepath.Join(d.SpoolDir, spoolFilePrefix+now.UTC().Format(spoolTimeLayout)+spoolFileExt+spoolPartialSuffix)
+	if _, err := os.Stat(strings.TrimSuffix(path, spoolPartialSuffix)); err == nil {
+		// A file completed within the same millisecond, start the next one a millisecond later.
+		return d.spoolFile(size, now.Add(time.Millisecond))
+	}
+	return path, nil
+}
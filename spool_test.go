@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func spoolFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func readSpoolLines(t *testing.T, path string) []Payload {
+	t.Helper()
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var payloads []Payload
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var payload Payload
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &payload))
+		payloads = append(payloads, payload)
+	}
+	require.NoError(t, scanner.Err())
+	return payloads
+}
+
+func TestWriteSpool_Rotation(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(t.TempDir(), "spool")
+	destination := newDestination(DestinationConfig{Name: "spool", Format: formatFile, SpoolDir: dir, SpoolMaxBytes: 300, SpoolMaxAge: time.Hour})
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	require.NoError(t, destination.writeSpool(testPayload("a"), start))
+	require.NoError(t, destination.writeSpool(testPayload("b"), start.Add(time.Second)))
+	assert.Equal(t, []string{"metrics-20240101T000000.000Z.ndjson.partial"}, spoolFiles(t, dir))
+
+	require.NoError(t, destination.writeSpool(testPayload("c"), start.Add(2*time.Second)))
+	assert.Equal(t, []string{
+		"metrics-20240101T000000.000Z.ndjson",
+		"metrics-20240101T000002.000Z.ndjson.partial",
+	}, spoolFiles(t, dir), "completed once the size limit is reached")
+	payloads := readSpoolLines(t, filepath.Join(dir, "metrics-20240101T000000.000Z.ndjson"))
+	require.Len(t, payloads, 2)
+	assert.Equal(t, "b", payloads[1].Metrics[0].Metric)
+
+	require.NoError(t, destination.writeSpool(testPayload("d"), start.Add(2*time.Hour)))
+	assert.Equal(t, []string{
+		"metrics-20240101T000000.000Z.ndjson",
+		"metrics-20240101T000002.000Z.ndjson",
+		"metrics-20240101T020000.000Z.ndjson.partial",
+	}, spoolFiles(t, dir), "completed once older than the age limit")
+
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	if os.PathSeparator == '/' {
+		assert.Equal(t, os.FileMode(storageDirMode), info.Mode().Perm())
+	}
+}
+
+func TestDestination_FileSinkBatching(t *testing.T) {
+	origConfig := config
+	config = Config{MetricsPath: filepath.Join(t.TempDir(), "metrics.json"), MaxPayloadMetrics: 2}
+	t.Cleanup(func() { config = origConfig })
+	dir := filepath.Join(t.TempDir(), "spool")
+	destination := newDestination(DestinationConfig{Name: "airgap", Format: formatFile, SpoolDir: dir})
+
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, destination.saveMetrics(testPayload(name)))
+	}
+	require.NoError(t, destination.sendQueuedMetrics())
+
+	files := spoolFiles(t, dir)
+	require.Len(t, files, 1)
+	payloads := readSpoolLines(t, filepath.Join(dir, files[0]))
+	require.Len(t, payloads, 2, "max_payload_metrics applies to the file sink")
+	assert.Len(t, payloads[0].Metrics, 2)
+	assert.NotEmpty(t, payloads[0].BatchID)
+	assert.Len(t, payloads[0].Records, 2)
+
+	records, err := pendingRecords(destination, false)
+	require.NoError(t, err)
+	assert.Empty(t, records, "written records are acknowledged")
+}
+
+func TestDestination_StdoutSink(t *testing.T) {
+	origConfig := config
+	origStdout := stdoutSink
+	var out bytes.Buffer
+	config = Config{MetricsPath: filepath.Join(t.TempDir(), "metrics.json"), MaxPayloadMetrics: 1}
+	stdoutSink = &out
+	t.Cleanup(func() {
+		config = origConfig
+		stdoutSink = origStdout
+	})
+
+	configured, err := configuredDestinations(Config{Destinations: []DestinationConfig{{Name: "debug", Format: formatStdout}}})
+	require.NoError(t, err)
+	destination := configured[0]
+	assert.Equal(t, "debug (stdout)", destination.String())
+
+	require.NoError(t, destination.saveMetrics(testPayload("a")))
+	require.NoError(t, destination.saveMetrics(testPayload("b")))
+	require.NoError(t, destination.sendQueuedMetrics())
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2, "one line per request")
+	var payload Payload
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &payload))
+	assert.Equal(t, "b", payload.Metrics[0].Metric)
+}
+
+func TestConfiguredDestinations_Sinks(t *testing.T) {
+	t.Parallel()
+
+	_, err := configuredDestinations(Config{Destinations: []DestinationConfig{{Name: "airgap", Format: formatFile}}})
+	assert.ErrorContains(t, err, "spool_dir")
+	_, err = configuredDestinations(Config{Destinations: []DestinationConfig{{Name: "airgap", Format: formatFile, SpoolDir: "/var/spool/uptinio"}}})
+	assert.NoError(t, err, "file sinks need no host")
+}
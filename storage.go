@@ -1,72 +1,228 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
+	"time"
 )
 
-// Limits growth when sends fail (e.g. HTTP 413), keeping roughly one hour at 60s intervals.
-const maxStoredMetrics = 360
+// Default retention when none is configured: a week of backlog within 512 MiB, so that a
+// day-long outage is kept with room to spare.
+const (
+	defaultRetentionMaxAge   = 7 * 24 * time.Hour
+	defaultRetentionMaxBytes = 512 * 1024 * 1024
+)
 
-// Save metrics to file
-func saveMetricsToFile(newPayload Payload) error {
-	filePath := config.MetricsPath
+// openMetricsQueue opens the metrics queue of the destination.
+func (d *Destination) openMetricsQueue() (*Queue, error) {
+	options, err := d.storageOptions()
+	if err != nil {
+		return nil, err
+	}
+	return openQueue(d.queueDir(), options)
+}
 
-	// Create the directory if it doesn't exist
-	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
-		return fmt.Errorf("error creating directory: %w", err)
+// storageOptions returns the storage settings with the encryption key resolved, derived
+// from the destination's auth token when no key file is set.
+func (d *Destination) storageOptions() (StorageConfig, error) {
+	options := config.Storage
+	var token string
+	if options.Encryption.Enabled && options.Encryption.KeyFile == "" {
+		var err error
+		if token, err = d.authToken(); err != nil {
+			return options, err
+		}
+	}
+	key, err := storageKey(options.Encryption, token)
+	if err != nil {
+		return options, err
 	}
+	options.key = key
+	return options, nil
+}
 
-	existingPayload, _ := loadMetricsFromFile()
+// migrateLegacyMetricsFile imports the metrics file written by older agent versions into the
+// queue of every active destination, like a collection, and removes it.
+func migrateLegacyMetricsFile() error {
+	data, err := os.ReadFile(config.MetricsPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error reading file: %w", err)
+	}
 
-	// Combine existing metrics with the new ones
-	existingPayload.Metrics = append(existingPayload.Metrics, newPayload.Metrics...)
-	if len(existingPayload.Metrics) > maxStoredMetrics {
-		existingPayload.Metrics = existingPayload.Metrics[len(existingPayload.Metrics)-maxStoredMetrics:]
+	payload, decodeErr := recoverLegacyPayload(data)
+	if len(payload.Metrics) > 0 {
+		for _, destination := range activeDestinations() {
+			if err := destination.appendPayload(payload); err != nil {
+				return fmt.Errorf("%s: %w", destination, err)
+			}
+		}
+	}
+	if decodeErr != nil {
+		quarantined, err := quarantineFile(config.MetricsPath)
+		if err != nil {
+			return err
+		}
+		reportCorruption("%v in legacy metrics file, recovered %d metrics, original kept at %s", decodeErr, len(payload.Metrics), quarantined)
+		return nil
 	}
-	existingPayload.Attributes = newPayload.Attributes
-	existingPayload.Version = newPayload.Version
+	log.Println("Imported legacy metrics file into queue:", config.MetricsPath)
+	return os.Remove(config.MetricsPath)
+}
 
-	// Create or overwrite the file
-	file, err := os.Create(filePath)
+func (d *Destination) appendPayload(payload Payload) error {
+	queue, err := d.openMetricsQueue()
 	if err != nil {
-		return fmt.Errorf("error creating file: %w", err)
+		return err
 	}
-	defer file.Close()
+	defer queue.Close()
+	_, err = queue.Append(payload)
+	return err
+}
+
+// Save metrics to the queue of every destination
+func saveMetricsToFile(newPayload Payload) error {
+	var errs []error
+	for _, destination := range activeDestinations() {
+		if err := destination.saveMetrics(newPayload); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", destination, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// saveMetrics appends the payload to the destination's queue and applies the retention.
+// While the destination is sending, compaction and eviction wait for the next collection.
+func (d *Destination) saveMetrics(newPayload Payload) error {
+	queue, err := d.openMetricsQueue()
+	if err != nil {
+		return err
+	}
+	defer queue.Close()
+
+	if _, err := queue.Append(newPayload); err != nil {
+		return err
+	}
+	if !d.sending.TryLock() {
+		updateQueueMetrics(queue, d.state.labels)
+		return nil
+	}
+	defer d.sending.Unlock()
 
-	encoder := json.NewEncoder(file)
-	if err := encoder.Encode(existingPayload); err != nil {
-		return fmt.Errorf("error encoding metrics: %w", err)
+	// Compact aged records into aggregates before the retention limits are reached, except
+	// those of the pending retry
+	var keep uint64
+	if d.state.retry != nil {
+		keep = d.state.retry.LastSeq
+	}
+	if err := downsampleQueue(queue, config.Downsample, retentionConfig(), time.Now(), keep); err != nil {
+		log.Println("Error downsampling metrics:", err)
 	}
-	log.Println("Saved metrics to file at:", filePath)
+
+	// Drop the oldest records once a retention limit is exceeded
+	records, points, err := queue.Evict(retentionConfig(), time.Now())
+	if err != nil {
+		return fmt.Errorf("error dropping old records: %w", err)
+	}
+	if records > 0 {
+		agentMetrics.Add("agent_dropped_records_total", float64(records))
+		agentMetrics.Add("agent_dropped_points_total", float64(points))
+		log.Printf("Retention limits exceeded: dropped %d records (%d points) from queue", records, points)
+		if retry := d.state.retry; retry != nil && queue.ackedSeq >= retry.FirstSeq {
+			d.state.retry = nil
+			log.Printf("Dropped records were part of the pending retry; the remaining metrics are sent under a new idempotency key")
+		}
+	}
+	updateQueueMetrics(queue, d.state.labels)
+	log.Println("Saved metrics to queue at:", queue.dir)
 	return nil
 }
 
-// Load metrics from file
-func loadMetricsFromFile() (Payload, error) {
-	filePath := config.MetricsPath // Get the full file path
+// retentionConfig returns the configured retention, using the defaults for unset age and size
+// limits: unlike max_records, they are always enforced.
+func retentionConfig() RetentionConfig {
+	retention := config.Retention
+	if retention.MaxAge == 0 {
+		retention.MaxAge = defaultRetentionMaxAge
+	}
+	if retention.MaxBytes == 0 {
+		retention.MaxBytes = defaultRetentionMaxBytes
+	}
+	return retention
+}
+
+// updateQueueMetrics publishes the backlog size as self-metrics with the destination's labels.
+func updateQueueMetrics(queue *Queue, labels map[string]string) {
+	agentMetrics.SetLabeled("agent_queue_records", labels, float64(queue.Len()))
+	if size, err := queue.Size(); err == nil {
+		agentMetrics.SetLabeled("agent_queue_bytes", labels, float64(size))
+	}
+}
 
-	file, err := os.Open(filePath)
-	if os.IsNotExist(err) {
-		return Payload{}, nil // File does not exist, return an empty payload
-	} else if err != nil {
-		return Payload{}, fmt.Errorf("error opening file: %w", err)
+// Load up to maxRecords of the oldest pending records from the queue as a single batch,
+// all of them when maxRecords is 0
+func (d *Destination) loadMetricsBatch(maxRecords int) (MetricsBatch, error) {
+	queue, err := d.openMetricsQueue()
+	if err != nil {
+		return MetricsBatch{}, err
+	}
+	defer queue.Close()
+
+	records, err := queue.Pending(maxRecords)
+	if err != nil {
+		return MetricsBatch{}, err
+	}
+	return mergeRecords(records), nil
+}
+
+// Acknowledge the records of a batch so they are removed from the queue.
+// Records appended after the batch was loaded are kept.
+func (d *Destination) ackMetricsBatch(batch MetricsBatch) error {
+	return d.ackMetricsRecords(batch.LastSeq)
+}
+
+// Acknowledge every queued record up to and including seq
+func (d *Destination) ackMetricsRecords(seq uint64) error {
+	queue, err := d.openMetricsQueue()
+	if err != nil {
+		return err
 	}
-	defer file.Close()
+	defer queue.Close()
+	return queue.Ack(seq)
+}
 
-	var payload Payload
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&payload); err != nil {
-		return Payload{}, fmt.Errorf("error decoding file: %w", err)
+// sentThroughSeq returns the last sequence number whose metrics are all within
+// the first sent metrics of the batch.
+func (b MetricsBatch) sentThroughSeq(sent int) uint64 {
+	if sent >= len(b.Seqs) {
+		return b.LastSeq
 	}
-	return payload, nil
+	return b.Seqs[sent] - 1
 }
 
-// Clear the file by deleting it
-func clearMetricsFile() error {
-	filePath := config.MetricsPath // Get the full file path
-	return os.Remove(filePath)
+// mergeRecords combines consecutive records into one payload, keeping the
+// version and attributes of the most recent record.
+func mergeRecords(records []QueueRecord) MetricsBatch {
+	var batch MetricsBatch
+	for _, record := range records {
+		if batch.FirstSeq == 0 {
+			batch.FirstSeq = record.Seq
+		}
+		batch.LastSeq = record.Seq
+		batch.Payload.Version = record.Payload.Version
+		batch.Payload.Attributes = record.Payload.Attributes
+		batch.Payload.Metrics = append(batch.Payload.Metrics, record.Payload.Metrics...)
+		for i := range record.Payload.Metrics {
+			batch.Seqs = append(batch.Seqs, record.Seq)
+			batch.Offsets = append(batch.Offsets, i)
+		}
+		if batch.IDs == nil {
+			batch.IDs = make(map[uint64]string)
+		}
+		batch.IDs[record.Seq] = record.ID
+	}
+	return batch
 }
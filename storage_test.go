@@ -1,29 +1,35 @@
 package main
 
 import (
-	"encoding/json"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-func TestSaveMetricsToFile_CapsStoredMetrics(t *testing.T) {
+func TestSaveMetricsToFile_CapsStoredRecords(t *testing.T) {
 	dir := t.TempDir()
 	metricsPath := filepath.Join(dir, "metrics.json")
+	const maxStoredRecords = 50
 
 	origConfig := config
-	config = Config{MetricsPath: metricsPath}
-	t.Cleanup(func() { config = origConfig })
+	origMetrics := agentMetrics
+	config = Config{MetricsPath: metricsPath, Retention: RetentionConfig{MaxRecords: maxStoredRecords}}
+	agentMetrics = NewSelfMetrics()
+	t.Cleanup(func() {
+		config = origConfig
+		agentMetrics = origMetrics
+	})
 
 	metric := func(name string) Metric {
 		return Metric{Metric: name, Value: 1, Timestamp: "2026-01-01T00:00:00Z"}
 	}
 
-	// Fill beyond cap (each save adds one metric).
-	for i := 0; i < maxStoredMetrics+10; i++ {
+	// Fill beyond cap (each save adds one record).
+	for i := 0; i < maxStoredRecords+10; i++ {
 		err := saveMetricsToFile(Payload{
 			Version:    "test",
 			Attributes: map[string]interface{}{"host": "test"},
@@ -32,9 +38,42 @@ func TestSaveMetricsToFile_CapsStoredMetrics(t *testing.T) {
 		require.NoError(t, err)
 	}
 
-	loaded, err := loadMetricsFromFile()
+	batch, err := defaultDestination().loadMetricsBatch(0)
 	require.NoError(t, err)
-	assert.Len(t, loaded.Metrics, maxStoredMetrics)
+	assert.Len(t, batch.Payload.Metrics, maxStoredRecords)
+	assert.Equal(t, uint64(11), batch.FirstSeq)
+	assert.Equal(t, 10.0, agentMetrics.Get("agent_dropped_points_total"))
+	assert.Equal(t, float64(maxStoredRecords), agentMetrics.Get("agent_queue_records"))
+}
+
+func TestRetentionConfig_Defaults(t *testing.T) {
+	origConfig := config
+	t.Cleanup(func() { config = origConfig })
+
+	config = Config{}
+	retention := retentionConfig()
+	assert.Greater(t, retention.MaxAge, 24*time.Hour, "a day-long outage is kept by default")
+	assert.Equal(t, int64(defaultRetentionMaxBytes), retention.MaxBytes)
+	assert.Zero(t, retention.MaxRecords)
+
+	config = Config{Retention: RetentionConfig{MaxAge: 72 * time.Hour, MaxBytes: 1 << 30, MaxRecords: 100}}
+	assert.Equal(t, config.Retention, retentionConfig())
+}
+
+func TestLegacyMetricsFileIsImportedIntoEveryDestination(t *testing.T) {
+	setupDestinations(t, nil, nil)
+	legacy := `{"agent_version":"v0","metrics":[{"metric":"mem_used_b","value":1024,"timestamp":"2026-01-01T00:00:00Z"}]}`
+	require.NoError(t, os.WriteFile(config.MetricsPath, []byte(legacy), 0o644))
+
+	require.NoError(t, migrateLegacyMetricsFile())
+	for _, d := range destinations {
+		records, err := pendingRecords(d, false)
+		require.NoError(t, err)
+		require.Len(t, records, 1, d.Name)
+		assert.Equal(t, "mem_used_b", records[0].Payload.Metrics[0].Metric)
+	}
+	_, err := os.Stat(config.MetricsPath)
+	assert.True(t, os.IsNotExist(err))
 }
 
 func TestSaveAndLoadMetricsRoundTrip(t *testing.T) {
@@ -57,29 +96,36 @@ func TestSaveAndLoadMetricsRoundTrip(t *testing.T) {
 
 	require.NoError(t, saveMetricsToFile(payload))
 
-	loaded, err := loadMetricsFromFile()
+	batch, err := defaultDestination().loadMetricsBatch(0)
 	require.NoError(t, err)
-	assert.Equal(t, payload.Version, loaded.Version)
-	assert.Equal(t, payload.Attributes["motherboard_id"], loaded.Attributes["motherboard_id"])
-	require.Len(t, loaded.Metrics, 1)
-	assert.Equal(t, payload.Metrics[0].Metric, loaded.Metrics[0].Metric)
+	assert.Equal(t, payload.Version, batch.Payload.Version)
+	assert.Equal(t, payload.Attributes["motherboard_id"], batch.Payload.Attributes["motherboard_id"])
+	require.Len(t, batch.Payload.Metrics, 1)
+	assert.Equal(t, payload.Metrics[0].Metric, batch.Payload.Metrics[0].Metric)
 }
 
-func TestClearMetricsFile(t *testing.T) {
+func TestAckMetricsBatch_KeepsRecordsSavedAfterLoad(t *testing.T) {
 	dir := t.TempDir()
-	metricsPath := filepath.Join(dir, "metrics.json")
 
 	origConfig := config
-	config = Config{MetricsPath: metricsPath}
+	config = Config{MetricsPath: filepath.Join(dir, "metrics.json")}
 	t.Cleanup(func() { config = origConfig })
 
-	require.NoError(t, os.WriteFile(metricsPath, []byte(`{"metrics":[]}`), 0o644))
-	require.NoError(t, clearMetricsFile())
-	_, err := os.Stat(metricsPath)
-	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, saveMetricsToFile(Payload{Version: "v1", Metrics: []Metric{{Metric: "first", Value: 1}}}))
+	batch, err := defaultDestination().loadMetricsBatch(0)
+	require.NoError(t, err)
+
+	require.NoError(t, saveMetricsToFile(Payload{Version: "v2", Metrics: []Metric{{Metric: "second", Value: 2}}}))
+	require.NoError(t, defaultDestination().ackMetricsBatch(batch))
+
+	remaining, err := defaultDestination().loadMetricsBatch(0)
+	require.NoError(t, err)
+	require.Len(t, remaining.Payload.Metrics, 1)
+	assert.Equal(t, "second", remaining.Payload.Metrics[0].Metric)
+	assert.Equal(t, "v2", remaining.Payload.Version)
 }
 
-func TestLoadMetricsFromFile_MissingFile(t *testing.T) {
+func TestLoadMetricsBatch_EmptyQueue(t *testing.T) {
 	dir := t.TempDir()
 	metricsPath := filepath.Join(dir, "does-not-exist.json")
 
@@ -87,16 +133,17 @@ func TestLoadMetricsFromFile_MissingFile(t *testing.T) {
 	config = Config{MetricsPath: metricsPath}
 	t.Cleanup(func() { config = origConfig })
 
-	payload, err := loadMetricsFromFile()
+	batch, err := defaultDestination().loadMetricsBatch(0)
 	require.NoError(t, err)
-	assert.Empty(t, payload.Metrics)
+	assert.Empty(t, batch.Payload.Metrics)
+	assert.Zero(t, batch.LastSeq)
 
 	raw, err := os.ReadFile(metricsPath)
 	require.Error(t, err)
 	assert.Nil(t, raw)
 }
 
-func TestMetricsFileJSONShape(t *testing.T) {
+func TestLegacyMetricsFileIsImported(t *testing.T) {
 	dir := t.TempDir()
 	metricsPath := filepath.Join(dir, "metrics.json")
 
@@ -104,17 +151,22 @@ func TestMetricsFileJSONShape(t *testing.T) {
 	config = Config{MetricsPath: metricsPath}
 	t.Cleanup(func() { config = origConfig })
 
+	legacy := `{"agent_version":"v0","attributes":{"motherboard_id":"abc"},"metrics":[{"metric":"mem_used_b","value":1024,"timestamp":"2026-01-01T00:00:00Z"}]}`
+	require.NoError(t, os.WriteFile(metricsPath, []byte(legacy), 0o644))
+
+	require.NoError(t, migrateLegacyMetricsFile())
 	require.NoError(t, saveMetricsToFile(Payload{
 		Version:    "v1",
 		Attributes: map[string]interface{}{"motherboard_id": "abc"},
-		Metrics:    []Metric{{Metric: "mem_used_b", Value: 1024, Timestamp: "2026-01-01T00:00:00Z"}},
+		Metrics:    []Metric{{Metric: "cpu_used", Value: 1, Timestamp: "2026-01-01T00:01:00Z"}},
 	}))
 
-	raw, err := os.ReadFile(metricsPath)
-	require.NoError(t, err)
+	_, err := os.Stat(metricsPath)
+	assert.True(t, os.IsNotExist(err))
 
-	var decoded map[string]interface{}
-	require.NoError(t, json.Unmarshal(raw, &decoded))
-	assert.Contains(t, decoded, "metrics")
-	assert.Contains(t, decoded, "attributes")
+	batch, err := defaultDestination().loadMetricsBatch(0)
+	require.NoError(t, err)
+	require.Len(t, batch.Payload.Metrics, 2)
+	assert.Equal(t, "mem_used_b", batch.Payload.Metrics[0].Metric)
+	assert.Equal(t, "cpu_used", batch.Payload.Metrics[1].Metric)
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	tokenCommandTimeout = 30 * time.Second
+	redacted            = "[REDACTED]"
+)
+
+var authTokens = &TokenSource{}
+
+// Token returns the token from the first configured source among auth_token_file,
+// auth_token_command, auth_token_env and auth_token. A token file is read again when its
+// modification time or size changes, the output of a credential helper is kept until
+// Invalidate is called.
+func (s *TokenSource) Token(cfg DestinationConfig) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case cfg.AuthTokenFile != "":
+		info, err := os.Stat(cfg.AuthTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("error reading auth token file: %w", err)
+		}
+		if s.valid && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+			return s.value, nil
+		}
+		data, err := os.ReadFile(cfg.AuthTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("error reading auth token file: %w", err)
+		}
+		if s.valid {
+			log.Printf("Auth token file %s changed; using the new token", cfg.AuthTokenFile)
+		}
+		s.value, s.valid = strings.TrimSpace(string(data)), true
+		s.modTime, s.size = info.ModTime(), info.Size()
+		return s.value, nil
+	case len(cfg.AuthTokenCommand) > 0:
+		if s.valid {
+			return s.value, nil
+		}
+		token, err := runTokenCommand(cfg.AuthTokenCommand)
+		if err != nil {
+			return "", err
+		}
+		s.value, s.valid = token, true
+		return s.value, nil
+	case cfg.AuthTokenEnv != "":
+		return strings.TrimSpace(os.Getenv(cfg.AuthTokenEnv)), nil
+	}
+	return strings.TrimSpace(cfg.AuthToken), nil
+}
+
+// Invalidate makes the next Token call read the file or run the credential helper again,
+// e.g. after the server rejected the token.
+func (s *TokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.valid = false
+}
+
+func runTokenCommand(command []string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tokenCommandTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error running auth token command: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// redactConfig returns a copy of the configuration without secrets, for printing.
+func redactConfig(cfg Config) Config {
+	if cfg.AuthToken != "" {
+		cfg.AuthToken = redacted
+	}
+	cfg.Destinations = append([]DestinationConfig(nil), cfg.Destinations...)
+	for i := range cfg.Destinations {
+		if cfg.Destinations[i].AuthToken != "" {
+			cfg.Destinations[i].AuthToken = redacted
+		}
+	}
+	if cfg.Signing.Secret != "" {
+		cfg.Signing.Secret = redacted
+	}
+	if cfg.ProxyURL != "" {
+		if proxyURL, err := url.Parse(cfg.ProxyURL); err == nil {
+			cfg.ProxyURL = proxyURL.Redacted()
+		} else {
+			cfg.ProxyURL = redacted
+		}
+	}
+	return cfg
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeClientCertificate writes a self-signed client certificate and key and returns their paths.
+func writeClientCertificate(t *testing.T) (*x509.Certificate, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "agent"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return cert, certFile, keyFile
+}
+
+// writeServerCA writes the certificate of a TLS test server as a CA file.
+func writeServerCA(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	return path
+}
+
+func createdHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusCreated)
+}
+
+func TestNewIngestHTTPClient_CAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(createdHandler))
+	t.Cleanup(server.Close)
+
+	client, err := newIngestHTTPClient(Config{})
+	require.NoError(t, err)
+	_, err = client.Get(server.URL)
+	require.Error(t, err, "the test CA is not trusted by default")
+
+	client, err = newIngestHTTPClient(Config{CAFile: writeServerCA(t, server)})
+	require.NoError(t, err)
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
+func TestNewIngestHTTPClient_MutualTLS(t *testing.T) {
+	clientCert, certFile, keyFile := writeClientCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "agent", r.TLS.PeerCertificates[0].Subject.CommonName)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	caFile := writeServerCA(t, server)
+
+	client, err := newIngestHTTPClient(Config{CAFile: caFile})
+	require.NoError(t, err)
+	_, err = client.Get(server.URL)
+	require.Error(t, err, "the server requires a client certificate")
+
+	client, err = newIngestHTTPClient(Config{CAFile: caFile, ClientCertFile: certFile, ClientKeyFile: keyFile})
+	require.NoError(t, err)
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
+func TestNewIngestHTTPClient_MinTLSVersion(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(createdHandler))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	caFile := writeServerCA(t, server)
+
+	client, err := newIngestHTTPClient(Config{CAFile: caFile, MinTLSVersion: "1.2"})
+	require.NoError(t, err)
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	client, err = newIngestHTTPClient(Config{CAFile: caFile, MinTLSVersion: "1.3"})
+	require.NoError(t, err)
+	_, err = client.Get(server.URL)
+	require.Error(t, err)
+}
+
+func TestNewIngestHTTPClient_ProxyConnectWithBasicAuth(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(createdHandler))
+	t.Cleanup(target.Close)
+
+	var mu sync.Mutex
+	var tunnels []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")) {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		mu.Lock()
+		tunnels = append(tunnels, r.Host)
+		mu.Unlock()
+
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	t.Cleanup(proxy.Close)
+	caFile := writeServerCA(t, target)
+
+	client, err := newIngestHTTPClient(Config{CAFile: caFile, ProxyURL: "http://user:wrong@" + proxy.Listener.Addr().String()})
+	require.NoError(t, err)
+	_, err = client.Get(target.URL)
+	require.Error(t, err)
+
+	client, err = newIngestHTTPClient(Config{CAFile: caFile, ProxyURL: "http://user:secret@" + proxy.Listener.Addr().String()})
+	require.NoError(t, err)
+	resp, err := client.Get(target.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{target.Listener.Addr().String()}, tunnels)
+}
+
+func TestNewIngestHTTPClient_InvalidSettings(t *testing.T) {
+	t.Parallel()
+
+	_, err := newIngestHTTPClient(Config{MinTLSVersion: "2.0"})
+	require.Error(t, err)
+	_, err = newIngestHTTPClient(Config{ProxyURL: "proxy:3128"})
+	require.Error(t, err)
+	_, err = newIngestHTTPClient(Config{CAFile: filepath.Join(t.TempDir(), "missing.pem")})
+	require.Error(t, err)
+	_, err = newIngestHTTPClient(Config{ClientCertFile: "client.crt"})
+	require.Error(t, err)
+}